@@ -9,6 +9,7 @@ require (
 	github.com/siebenmann/go-kstat v0.0.0-20200303194639-4e8294f9e9d5
 	github.com/snltd/solaris-telegraf-helpers v0.0.0-20210416214443-a9adf06d4abf
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/sys v0.0.0-20210228012217-479acdf4ea46
 )
 
 replace github.com/snltd/solaris-telegraf-helpers => ../solaris-telegraf-helpers
@@ -0,0 +1,667 @@
+package illumos_nfs
+
+import (
+	"fmt"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/siebenmann/go-kstat"
+	sh "github.com/snltd/solaris-telegraf-helpers"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sampleConfig = `
+	## Whether to report on the NFS client, the NFS server, or both
+	# roles = ["client", "server"]
+	## The NFS versions you wish to monitor.
+	# nfs_versions = ["v3", "v4"]
+	## Whether to report ordinary NFS operations, NFS ACL operations, or both
+	# op_families = ["nfs", "acl"]
+	## Whether to break NFS server operations down by share. Kernels without per-share kstats
+	## report the server-wide counters instead
+	# per_share = false
+	## Whether to work out, each interval, the calls per second for each NFS version, and the
+	## percentage of those calls taken by each operation
+	# op_mix = false
+	## The kstat fields you wish to emit. 'kstat -p -m nfs -i 0 | grep rfs' lists the possibilities
+	# fields = ["read", "write", "remove", "create", "getattr", "setattr"]
+	## Whether to report RPC statistics, as shown by 'nfsstat -rc' and 'nfsstat -rs'
+	# rpc = true
+	## The RPC kstat fields you wish to emit. 'kstat -p -m unix -c rpc' lists the possibilities
+	# rpc_fields = ["calls", "badcalls", "retrans", "badxids", "timeouts", "dupreqs"]
+	## Whether to statvfs(2) each NFS mount, to find out whether it is responding
+	# mount_probe = false
+	## How long to wait for a mount to respond before calling it hung
+	# mount_probe_timeout = "5s"
+	## Whether to report the size and occupancy of the NFS server thread pool. Requires the
+	## privileges to run 'mdb -k'
+	# server_threads = false
+	## Whether to report NFSv4 server state counts. Requires the privileges to run 'mdb -k', and
+	## to run DTrace, which counts delegation recalls
+	# v4_state = false
+`
+
+func (s *IllumosNfs) Description() string {
+	return "Reports Illumos NFS client and server statistics"
+}
+
+func (s *IllumosNfs) SampleConfig() string {
+	return sampleConfig
+}
+
+type IllumosNfs struct {
+	Roles             []string
+	Fields            []string
+	NfsVersions       []string
+	OpFamilies        []string
+	PerShare          bool
+	OpMix             bool
+	Rpc               bool
+	RpcFields         []string
+	MountProbe        bool
+	MountProbeTimeout config.Duration
+	ServerThreads     bool
+	V4State           bool
+	// legacy is set by the illumos_nfs_client and illumos_nfs_server aliases, and makes the plugin
+	// name its measurements the way those plugins always did.
+	legacy bool
+	// lastOps holds the previous sample of each operation kstat, for working out the op mix.
+	lastOps map[string]opSample
+	prober  *mountProber
+	recalls *recallWatcher
+}
+
+// opSample is a snapshot of the counters in an operation kstat.
+type opSample struct {
+	snaptime int64
+	counts   map[string]uint64
+}
+
+// Operation counts live in kstats named like rfsreqcnt_v3 or aclproccnt_v4. The prefix says
+// whether they count ordinary NFS or ACL operations, the middle whether they are for the client or
+// the server, and the suffix gives the protocol version.
+var opKstatName = regexp.MustCompile(`^(rfs|acl)(reqcnt|proccnt)_v([0-9]+)$`)
+
+// Kernels which count server operations per share give each share its own kstat instance. In it,
+// nfs:<instance>:share_path holds the share's path, and there is an I/O kstat for each operation,
+// named like rfsprocio_v3_read or rfsprocio_v4_write.
+var shareOpKstatName = regexp.MustCompile(`^rfsprocio_v([0-9]+)_([a-z0-9_]+)$`)
+
+var opFamilies = map[string]string{
+	"rfs": "nfs",
+	"acl": "acl",
+}
+
+var opRoles = map[string]string{
+	"reqcnt":  "client",
+	"proccnt": "server",
+}
+
+// opKstat describes the operation counts held in a single kstat.
+type opKstat struct {
+	family  string
+	role    string
+	version string
+}
+
+// shareOpKstat describes a single operation in a per-share I/O kstat.
+type shareOpKstat struct {
+	version string
+	op      string
+}
+
+// rpcTransports are the two flavours of RPC kstat: connection-oriented and connectionless.
+var rpcTransports = []string{"cots", "clts"}
+
+// defaultMountProbeTimeout is used if the user doesn't set mount_probe_timeout.
+const defaultMountProbeTimeout = 5 * time.Second
+
+// v4StateTables maps the names of the NFSv4 server's state tables to the fields we report their
+// sizes as.
+var v4StateTables = map[string]string{
+	"Client":       "clients",
+	"OpenOwner":    "open_owners",
+	"DelegStateID": "delegations",
+}
+
+var sharectlOutput = func() string {
+	return sh.RunCmd("/usr/sbin/sharectl get -p servers nfs")
+}
+
+// mdbOutput runs a single dcmd against the live kernel. It can't go through sh.RunCmd, because
+// the dcmd has spaces in it.
+var mdbOutput = func(dcmd string) string {
+	out, err := exec.Command("/bin/pfexec", "/usr/bin/mdb", "-ke", dcmd).Output()
+
+	if err != nil {
+		log.Printf("cannot run mdb dcmd '%s': %v", dcmd, err)
+	}
+
+	return string(out)
+}
+
+func (s *IllumosNfs) Gather(acc telegraf.Accumulator) error {
+	token, err := kstat.Open()
+
+	if err != nil {
+		log.Fatal("cannot get kstat token")
+	}
+
+	s.gatherOps(acc, sh.KstatModule(token, "nfs"))
+
+	if s.Rpc {
+		for _, role := range []string{"client", "server"} {
+			if sh.WeWant(role, s.Roles) {
+				s.gatherRpc(acc, token, role)
+			}
+		}
+	}
+
+	if s.MountProbe && sh.WeWant("client", s.Roles) {
+		s.gatherMounts(acc)
+	}
+
+	if sh.WeWant("server", s.Roles) {
+		if s.ServerThreads {
+			s.addFields(
+				acc,
+				"server",
+				"threads",
+				parseSvcPool(mdbOutput("::svc_pool nfs"), sharectlOutput()),
+				map[string]string{})
+		}
+
+		if s.V4State {
+			s.gatherV4State(acc)
+		}
+	}
+
+	token.Close()
+	return nil
+}
+
+// gatherOps emits the per-version operation counts for each role and operation family.
+func (s *IllumosNfs) gatherOps(acc telegraf.Accumulator, ks []*kstat.KStat) {
+	haveShareKstats := false
+
+	if s.PerShare && sh.WeWant("server", s.Roles) && sh.WeWant("nfs", s.OpFamilies) {
+		haveShareKstats = s.gatherShares(acc, ks)
+	}
+
+	for _, stat := range ks {
+		if !strings.Contains(stat.Name, "reqcnt") && !strings.Contains(stat.Name, "proccnt") {
+			continue
+		}
+
+		op, err := parseOpKstatName(stat.Name)
+
+		if err != nil {
+			acc.AddError(err)
+			continue
+		}
+
+		if !s.useOp(op, haveShareKstats) || !sh.WeWant(op.role, s.Roles) ||
+			!sh.WeWant(op.family, s.OpFamilies) || !sh.WeWant(op.version, s.NfsVersions) {
+			continue
+		}
+
+		tags := map[string]string{"nfsVersion": op.version, "op_family": op.family}
+		stats, err := stat.AllNamed()
+
+		if err != nil {
+			log.Fatal("cannot get named NFS kstats")
+		}
+
+		if s.OpMix {
+			s.gatherOpMix(acc, op.role, stat, stats, tags)
+		}
+
+		s.addFields(acc, op.role, "", namedFields(stats, s.Fields), tags)
+	}
+}
+
+// gatherShares emits the NFS server operation counts for each share, tagged with the share's
+// path. It returns false if the kernel does not count operations per share.
+func (s *IllumosNfs) gatherShares(acc telegraf.Accumulator, ks []*kstat.KStat) bool {
+	paths := sharePaths(acc, ks)
+
+	if len(paths) == 0 {
+		return false
+	}
+
+	// instance -> NFS version -> fields
+	shareFields := make(map[int]map[string]map[string]interface{})
+
+	for _, stat := range ks {
+		if !strings.HasPrefix(stat.Name, "rfsprocio_") {
+			continue
+		}
+
+		op, err := parseShareOpKstatName(stat.Name)
+
+		if err != nil {
+			acc.AddError(err)
+			continue
+		}
+
+		if !sh.WeWant(op.version, s.NfsVersions) || !sh.WeWant(op.op, s.Fields) {
+			continue
+		}
+
+		io, err := stat.GetIO()
+
+		if err != nil {
+			acc.AddError(fmt.Errorf("cannot read kstat %s: %v", stat.Name, err))
+			continue
+		}
+
+		if shareFields[stat.Instance] == nil {
+			shareFields[stat.Instance] = make(map[string]map[string]interface{})
+		}
+
+		if shareFields[stat.Instance][op.version] == nil {
+			shareFields[stat.Instance][op.version] = make(map[string]interface{})
+		}
+
+		shareFields[stat.Instance][op.version][op.op] = shareOpCount(io)
+	}
+
+	for instance, versions := range shareFields {
+		path, ok := paths[instance]
+
+		if !ok {
+			continue
+		}
+
+		for version, fields := range versions {
+			s.addFields(
+				acc,
+				"server",
+				"",
+				fields,
+				map[string]string{"nfsVersion": version, "op_family": "nfs", "share": path})
+		}
+	}
+
+	return true
+}
+
+// sharePaths maps the instance of each per-share kstat to the path of the share it counts, which
+// it reads from the instance's share_path kstat.
+func sharePaths(acc telegraf.Accumulator, ks []*kstat.KStat) map[int]string {
+	paths := make(map[int]string)
+
+	for _, stat := range ks {
+		if stat.Name != "share_path" {
+			continue
+		}
+
+		path, err := stat.GetNamed("path")
+
+		if err != nil {
+			acc.AddError(fmt.Errorf("cannot get path of NFS share %d: %v", stat.Instance, err))
+			continue
+		}
+
+		paths[stat.Instance] = path.StringVal
+	}
+
+	return paths
+}
+
+// shareOpCount is the number of times an operation has been performed on a share. The kernel
+// counts them in the I/O kstat as reads or writes, depending on the operation.
+func shareOpCount(io *kstat.IO) uint64 {
+	return uint64(io.Reads) + uint64(io.Writes)
+}
+
+// gatherOpMix compares the counters in an operation kstat with those we saw last time, and emits
+// the calls per second and the percentage of calls taken by each operation. Nothing is sent on
+// the first run.
+func (s *IllumosNfs) gatherOpMix(
+	acc telegraf.Accumulator,
+	role string,
+	ks *kstat.KStat,
+	stats []*kstat.Named,
+	tags map[string]string) {
+	if s.lastOps == nil {
+		s.lastOps = make(map[string]opSample)
+	}
+
+	key := fmt.Sprintf("%s:%d:%s", ks.Module, ks.Instance, ks.Name)
+	sample := opSample{snaptime: ks.Snaptime, counts: opCounts(stats)}
+	last, seen := s.lastOps[key]
+	s.lastOps[key] = sample
+
+	if !seen {
+		return
+	}
+
+	mixTags := make(map[string]string)
+
+	for k, v := range tags {
+		mixTags[k] = v
+	}
+
+	s.addFields(acc, role, "mix", opMix(last, sample, s.Fields), mixTags)
+}
+
+// opCounts pulls the raw counter values out of an operation kstat.
+func opCounts(stats []*kstat.Named) map[string]uint64 {
+	ret := make(map[string]uint64)
+
+	for _, stat := range stats {
+		if strings.HasPrefix(fmt.Sprintf("%s", stat.Type), "uint") {
+			ret[stat.Name] = stat.UintVal
+		}
+	}
+
+	return ret
+}
+
+// opMix works out the total calls per second between two samples, and the percentage of those
+// calls taken by each operation in want. If the counters went backwards, say because the module
+// was reloaded, there is nothing sensible to report.
+func opMix(last, now opSample, want []string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	elapsed := float64(now.snaptime-last.snaptime) / 1e9
+
+	if elapsed <= 0 {
+		return fields
+	}
+
+	deltas := make(map[string]uint64)
+	var total uint64
+
+	for op, count := range now.counts {
+		if count < last.counts[op] {
+			return fields
+		}
+
+		deltas[op] = count - last.counts[op]
+		total += deltas[op]
+	}
+
+	fields["calls_per_sec"] = float64(total) / elapsed
+
+	for op, delta := range deltas {
+		if !sh.WeWant(op, want) {
+			continue
+		}
+
+		pc := 0.0
+
+		if total > 0 {
+			pc = float64(delta) / float64(total) * 100
+		}
+
+		fields[fmt.Sprintf("%s_pct", op)] = pc
+	}
+
+	return fields
+}
+
+// useOp decides whether or not to report a server-wide operation kstat. If the user asks for
+// per-share counts and the kernel has them, the server-wide NFS counters which they break down are
+// dropped, so nothing is counted twice. If there are no per-share kstats, we fall back to the
+// server-wide ones.
+func (s *IllumosNfs) useOp(op opKstat, haveShareKstats bool) bool {
+	return !(s.PerShare && haveShareKstats && op.role == "server" && op.family == "nfs")
+}
+
+// parseOpKstatName works out what an operation-count kstat holds from its name. Anything which
+// isn't the shape we expect is an error, rather than a guess.
+func parseOpKstatName(name string) (opKstat, error) {
+	match := opKstatName.FindStringSubmatch(name)
+
+	if match == nil {
+		return opKstat{}, fmt.Errorf("unrecognised NFS operation kstat: %s", name)
+	}
+
+	return opKstat{
+		family:  opFamilies[match[1]],
+		role:    opRoles[match[2]],
+		version: fmt.Sprintf("v%s", match[3]),
+	}, nil
+}
+
+// parseShareOpKstatName works out the NFS version and operation counted by a per-share I/O kstat.
+func parseShareOpKstatName(name string) (shareOpKstat, error) {
+	match := shareOpKstatName.FindStringSubmatch(name)
+
+	if match == nil {
+		return shareOpKstat{}, fmt.Errorf("unrecognised NFS share kstat: %s", name)
+	}
+
+	return shareOpKstat{version: fmt.Sprintf("v%s", match[1]), op: match[2]}, nil
+}
+
+// gatherMounts probes every NFS mount in mnttab, and reports whether or not it answered, and how
+// long it took. It never waits longer than the probe timeout, whatever state the mounts are in.
+func (s *IllumosNfs) gatherMounts(acc telegraf.Accumulator) {
+	if s.prober == nil {
+		s.prober = newMountProber()
+	}
+
+	timeout := time.Duration(s.MountProbeTimeout)
+
+	if timeout <= 0 {
+		timeout = defaultMountProbeTimeout
+	}
+
+	for _, result := range s.prober.probeAll(parseMnttab(mnttabContents()), timeout) {
+		responsive := 0
+
+		if result.responsive {
+			responsive = 1
+		}
+
+		s.addFields(
+			acc,
+			"client",
+			"mount",
+			map[string]interface{}{
+				"responsive": responsive,
+				"latency_ms": float64(result.latency) / float64(time.Millisecond),
+			},
+			map[string]string{
+				"mountpoint": result.mount.mountpoint,
+				"resource":   result.mount.resource,
+			})
+	}
+}
+
+// gatherRpc emits the rpcmod statistics for each transport. These live in, for instance,
+// unix:0:rpc_cots_client and unix:0:rpc_clts_server.
+func (s *IllumosNfs) gatherRpc(acc telegraf.Accumulator, token *kstat.Token, role string) {
+	for _, transport := range rpcTransports {
+		ks, err := token.Lookup("unix", 0, fmt.Sprintf("rpc_%s_%s", transport, role))
+
+		if err != nil {
+			continue
+		}
+
+		stats, err := ks.AllNamed()
+
+		if err != nil {
+			log.Fatal("cannot get named RPC kstats")
+		}
+
+		s.addFields(
+			acc,
+			role,
+			"rpc",
+			namedFields(stats, s.RpcFields),
+			map[string]string{"transport": transport})
+	}
+}
+
+// parseSvcPool turns the output of the '::svc_pool nfs' dcmd, which describes the RPC service
+// pool used by nfsd, and of 'sharectl get -p servers nfs', into a map of fields.
+func parseSvcPool(raw, rawSharectl string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	pool := make(map[string]int)
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.SplitN(line, "=", 2)
+
+		if len(chunks) != 2 {
+			continue
+		}
+
+		val, err := strconv.Atoi(strings.TrimSpace(chunks[1]))
+
+		if err != nil {
+			continue
+		}
+
+		pool[strings.TrimSpace(chunks[0])] = val
+	}
+
+	if len(pool) > 0 {
+		threads := pool["Non detached threads"] + pool["Detached threads"]
+		fields["max_threads"] = pool["Max threads"]
+		fields["threads"] = threads
+		fields["idle_threads"] = pool["Asleep threads"]
+		fields["active_threads"] = threads - pool["Asleep threads"]
+		fields["queued_requests"] = pool["Pending requests"]
+	}
+
+	if strings.HasPrefix(rawSharectl, "servers=") {
+		servers, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(rawSharectl, "servers=")))
+
+		if err == nil {
+			fields["max_servers"] = servers
+		}
+	}
+
+	return fields
+}
+
+// gatherV4State sends the sizes of the NFSv4 server's state tables, and the number of delegations
+// recalled since Telegraf started.
+func (s *IllumosNfs) gatherV4State(acc telegraf.Accumulator) {
+	if s.recalls == nil {
+		s.recalls = &recallWatcher{}
+	}
+
+	fields := parseRfs4Db(mdbOutput("::rfs4_db"))
+	recalls, counting, err := s.recalls.recalls()
+
+	if err != nil {
+		acc.AddError(fmt.Errorf("cannot trace delegation recalls: %v", err))
+	} else if counting {
+		fields["delegations_recalled"] = recalls
+	}
+
+	s.addFields(acc, "server", "v4state", fields, map[string]string{})
+}
+
+// parseRfs4Db picks the number of entries in each of the NFSv4 server's state tables out of the
+// output of the '::rfs4_db' dcmd. Each table is a line of the form
+// <address> <name> <flags> <count> <buckets> ...
+func parseRfs4Db(raw string) map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.Fields(line)
+
+		if len(chunks) < 4 {
+			continue
+		}
+
+		field, ok := v4StateTables[chunks[1]]
+
+		if !ok {
+			continue
+		}
+
+		count, err := strconv.Atoi(chunks[3])
+
+		if err == nil {
+			fields[field] = count
+		}
+	}
+
+	return fields
+}
+
+// addFields sends a point. The compatibility aliases put the role in the measurement name, as the
+// old client and server plugins did, and don't have an op_family tag. illumos_nfs puts the role in
+// a tag.
+func (s *IllumosNfs) addFields(
+	acc telegraf.Accumulator,
+	role, subsystem string,
+	fields map[string]interface{},
+	tags map[string]string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	measurement := "nfs"
+
+	if s.legacy {
+		measurement = fmt.Sprintf("nfs.%s", role)
+		delete(tags, "op_family")
+	} else {
+		tags["role"] = role
+	}
+
+	if subsystem != "" {
+		measurement = fmt.Sprintf("%s.%s", measurement, subsystem)
+	}
+
+	acc.AddFields(measurement, fields, tags)
+}
+
+// namedFields turns a list of named kstats into a map of fields, discarding anything not in want.
+func namedFields(stats []*kstat.Named, want []string) map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	for _, stat := range stats {
+		if !sh.WeWant(stat.Name, want) {
+			continue
+		}
+
+		// cannot type switch on non-interface value stat (type *kstat.Named), hence this hack
+		valueType := fmt.Sprintf("%s", stat.Type)
+
+		if strings.HasPrefix(valueType, "uint") {
+			fields[stat.Name] = stat.UintVal
+		} else if strings.HasPrefix(valueType, "int") {
+			fields[stat.Name] = stat.IntVal
+		}
+	}
+
+	return fields
+}
+
+// Start does nothing. It is only here so Telegraf calls Stop.
+func (s *IllumosNfs) Start(acc telegraf.Accumulator) error {
+	return nil
+}
+
+// Stop kills the delegation recall DTrace, if there is one.
+func (s *IllumosNfs) Stop() {
+	if s.recalls != nil {
+		s.recalls.close()
+	}
+}
+
+func init() {
+	inputs.Add("illumos_nfs", func() telegraf.Input { return &IllumosNfs{} })
+
+	// The separate client and server plugins were folded into this one. Their names live on.
+	inputs.Add("illumos_nfs_client", func() telegraf.Input {
+		return &IllumosNfs{Roles: []string{"client"}, OpFamilies: []string{"nfs"}, legacy: true}
+	})
+
+	inputs.Add("illumos_nfs_server", func() telegraf.Input {
+		return &IllumosNfs{Roles: []string{"server"}, OpFamilies: []string{"nfs"}, legacy: true}
+	})
+}
@@ -0,0 +1,418 @@
+package illumos_nfs
+
+import (
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/siebenmann/go-kstat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// These tests are sketchy. They need to run on a system with kstats, and worse than that, they
+// need to run on a system which hasn't served and NFS content. I imagine it's possible to mock the
+// kstat calls, but it's something I don't have the energy for at the moment.
+func TestPlugin(t *testing.T) {
+	s := &IllumosNfs{
+		Fields:      []string{"read", "write", "remove", "create"},
+		NfsVersions: []string{"v3", "v4"},
+	}
+
+	acc := testutil.Accumulator{}
+	require.NoError(t, s.Gather(&acc))
+
+	testutil.RequireMetricsEqual(
+		t,
+		testMetrics,
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime(),
+	)
+}
+
+func TestPluginLegacyClient(t *testing.T) {
+	s := &IllumosNfs{
+		Roles:       []string{"client"},
+		Fields:      []string{"read", "write", "remove", "create"},
+		NfsVersions: []string{"v3", "v4"},
+		OpFamilies:  []string{"nfs"},
+		legacy:      true,
+	}
+
+	acc := testutil.Accumulator{}
+	require.NoError(t, s.Gather(&acc))
+
+	testutil.RequireMetricsEqual(
+		t,
+		legacyMetrics("nfs.client"),
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime(),
+	)
+}
+
+func TestPluginLegacyServer(t *testing.T) {
+	s := &IllumosNfs{
+		Roles:       []string{"server"},
+		Fields:      []string{"read", "write", "remove", "create"},
+		NfsVersions: []string{"v3", "v4"},
+		OpFamilies:  []string{"nfs"},
+		legacy:      true,
+	}
+
+	acc := testutil.Accumulator{}
+	require.NoError(t, s.Gather(&acc))
+
+	testutil.RequireMetricsEqual(
+		t,
+		legacyMetrics("nfs.server"),
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime(),
+	)
+}
+
+func TestAddFields(t *testing.T) {
+	fields := map[string]interface{}{"calls": uint64(5)}
+
+	acc := testutil.Accumulator{}
+	s := &IllumosNfs{}
+	s.addFields(&acc, "client", "", fields, map[string]string{"nfsVersion": "v4", "op_family": "acl"})
+	s.addFields(&acc, "server", "rpc", fields, map[string]string{"transport": "cots"})
+
+	legacyAcc := testutil.Accumulator{}
+	legacy := &IllumosNfs{legacy: true}
+	legacy.addFields(
+		&legacyAcc, "client", "", fields, map[string]string{"nfsVersion": "v4", "op_family": "nfs"})
+	legacy.addFields(&legacyAcc, "client", "", map[string]interface{}{}, map[string]string{})
+	legacy.addFields(&legacyAcc, "server", "rpc", fields, map[string]string{"transport": "cots"})
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"nfs",
+				map[string]string{"nfsVersion": "v4", "op_family": "acl", "role": "client"},
+				fields,
+				time.Now(),
+			),
+			testutil.MustMetric(
+				"nfs.rpc",
+				map[string]string{"transport": "cots", "role": "server"},
+				fields,
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime(),
+	)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"nfs.client",
+				map[string]string{"nfsVersion": "v4"},
+				fields,
+				time.Now(),
+			),
+			testutil.MustMetric(
+				"nfs.server.rpc",
+				map[string]string{"transport": "cots"},
+				fields,
+				time.Now(),
+			),
+		},
+		legacyAcc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime(),
+	)
+}
+
+func TestParseOpKstatName(t *testing.T) {
+	tests := map[string]opKstat{
+		"rfsreqcnt_v3":  {family: "nfs", role: "client", version: "v3"},
+		"rfsproccnt_v4": {family: "nfs", role: "server", version: "v4"},
+		"aclreqcnt_v2":  {family: "acl", role: "client", version: "v2"},
+		"aclproccnt_v3": {family: "acl", role: "server", version: "v3"},
+		"rfsreqcnt_v10": {family: "nfs", role: "client", version: "v10"},
+	}
+
+	for name, expected := range tests {
+		op, err := parseOpKstatName(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, op)
+	}
+
+	for _, name := range []string{"rfsreqcnt_v", "rfsreqcnt_v4_zone", "rfsproccnt", "nfsproccnt_v3",
+		"aclreqcnt_vfour", "rfsprocio_v3_read"} {
+		_, err := parseOpKstatName(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseShareOpKstatName(t *testing.T) {
+	tests := map[string]shareOpKstat{
+		"rfsprocio_v3_read":    {version: "v3", op: "read"},
+		"rfsprocio_v4_write":   {version: "v4", op: "write"},
+		"rfsprocio_v3_getattr": {version: "v3", op: "getattr"},
+		"rfsprocio_v4_cb_null": {version: "v4", op: "cb_null"},
+	}
+
+	for name, expected := range tests {
+		op, err := parseShareOpKstatName(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, op)
+	}
+
+	for _, name := range []string{"rfsprocio_v3", "rfsprocio_v3_", "rfsprocio_vfour_read",
+		"rfsproccnt_v3", "share_path"} {
+		_, err := parseShareOpKstatName(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestUseOp(t *testing.T) {
+	global := opKstat{family: "nfs", role: "server", version: "v3"}
+	globalAcl := opKstat{family: "acl", role: "server", version: "v3"}
+	client := opKstat{family: "nfs", role: "client", version: "v3"}
+
+	perShare := &IllumosNfs{PerShare: true}
+	assert.False(t, perShare.useOp(global, true))
+	assert.True(t, perShare.useOp(global, false))
+	assert.True(t, perShare.useOp(globalAcl, true))
+	assert.True(t, perShare.useOp(client, true))
+
+	noShare := &IllumosNfs{}
+	assert.True(t, noShare.useOp(global, true))
+	assert.True(t, noShare.useOp(globalAcl, true))
+}
+
+func TestShareOpCount(t *testing.T) {
+	assert.Equal(t, uint64(8820), shareOpCount(&kstat.IO{Reads: 8820}))
+	assert.Equal(t, uint64(1337), shareOpCount(&kstat.IO{Writes: 1337}))
+}
+
+func TestOpMix(t *testing.T) {
+	last := opSample{
+		snaptime: 1000000000,
+		counts:   map[string]uint64{"read": 100, "write": 50, "getattr": 300, "null": 0},
+	}
+
+	now := opSample{
+		snaptime: 11000000000,
+		counts:   map[string]uint64{"read": 160, "write": 70, "getattr": 400, "null": 20},
+	}
+
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"calls_per_sec": 20.0,
+			"read_pct":      30.0,
+			"write_pct":     10.0,
+			"getattr_pct":   50.0,
+			"null_pct":      10.0,
+		},
+		opMix(last, now, []string{}))
+
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"calls_per_sec": 20.0,
+			"getattr_pct":   50.0,
+		},
+		opMix(last, now, []string{"getattr", "lookup"}))
+
+	assert.Equal(
+		t,
+		map[string]interface{}{"calls_per_sec": 0.0, "read_pct": 0.0},
+		opMix(now, opSample{snaptime: 12000000000, counts: map[string]uint64{"read": 160}},
+			[]string{"read"}))
+
+	assert.Equal(t, map[string]interface{}{}, opMix(now, last, []string{}))
+	assert.Equal(t, map[string]interface{}{}, opMix(last, last, []string{}))
+}
+
+func TestGatherOpMix(t *testing.T) {
+	s := &IllumosNfs{Fields: []string{"read", "write"}}
+	acc := testutil.Accumulator{}
+	tags := map[string]string{"nfsVersion": "v3", "op_family": "nfs"}
+	ks := &kstat.KStat{Module: "nfs", Name: "rfsproccnt_v3", Snaptime: 5000000000}
+
+	s.gatherOpMix(&acc, "server", ks, []*kstat.Named{
+		{Name: "read", Type: kstat.Uint64, UintVal: 10},
+		{Name: "write", Type: kstat.Uint64, UintVal: 10},
+	}, tags)
+
+	assert.Empty(t, acc.GetTelegrafMetrics())
+
+	ks.Snaptime = 7000000000
+
+	s.gatherOpMix(&acc, "server", ks, []*kstat.Named{
+		{Name: "read", Type: kstat.Uint64, UintVal: 40},
+		{Name: "write", Type: kstat.Uint64, UintVal: 20},
+	}, tags)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"nfs.mix",
+				map[string]string{"nfsVersion": "v3", "op_family": "nfs", "role": "server"},
+				map[string]interface{}{
+					"calls_per_sec": 20.0,
+					"read_pct":      75.0,
+					"write_pct":     25.0,
+				},
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime(),
+	)
+
+	assert.NotContains(t, tags, "role")
+}
+
+func TestParseSvcPool(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"max_servers":     1024,
+			"max_threads":     1024,
+			"threads":         18,
+			"idle_threads":    15,
+			"active_threads":  3,
+			"queued_requests": 2,
+		},
+		parseSvcPool(svcPoolOutput, "servers=1024"))
+
+	assert.Equal(
+		t,
+		map[string]interface{}{"max_servers": 16},
+		parseSvcPool("mdb: failed to dereference symbol: unknown symbol name", "servers=16\n"))
+}
+
+func TestParseRfs4Db(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"clients":     12,
+			"open_owners": 31,
+			"delegations": 4,
+		},
+		parseRfs4Db(rfs4DbOutput))
+
+	assert.Equal(t, map[string]interface{}{}, parseRfs4Db(""))
+}
+
+func TestNamedFields(t *testing.T) {
+	stats := []*kstat.Named{
+		{Name: "calls", Type: kstat.Uint64, UintVal: 1292},
+		{Name: "badcalls", Type: kstat.Uint64, UintVal: 3},
+		{Name: "timeouts", Type: kstat.Int64, IntVal: 7},
+		{Name: "nomem", Type: kstat.Uint64, UintVal: 0},
+	}
+
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"calls":    uint64(1292),
+			"badcalls": uint64(3),
+			"timeouts": int64(7),
+			"nomem":    uint64(0),
+		},
+		namedFields(stats, []string{}))
+
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"calls":    uint64(1292),
+			"timeouts": int64(7),
+		},
+		namedFields(stats, []string{"calls", "timeouts", "retrans"}))
+}
+
+var zeroFields = map[string]interface{}{
+	"create": uint64(0),
+	"write":  uint64(0),
+	"remove": uint64(0),
+	"read":   uint64(0),
+}
+
+func legacyMetrics(measurement string) []telegraf.Metric {
+	return []telegraf.Metric{
+		testutil.MustMetric(
+			measurement,
+			map[string]string{"nfsVersion": "v3"},
+			zeroFields,
+			time.Now(),
+		),
+		testutil.MustMetric(
+			measurement,
+			map[string]string{"nfsVersion": "v4"},
+			zeroFields,
+			time.Now(),
+		),
+	}
+}
+
+var testMetrics = []telegraf.Metric{
+	testutil.MustMetric(
+		"nfs",
+		map[string]string{"nfsVersion": "v3", "op_family": "nfs", "role": "client"},
+		zeroFields,
+		time.Now(),
+	),
+	testutil.MustMetric(
+		"nfs",
+		map[string]string{"nfsVersion": "v4", "op_family": "nfs", "role": "client"},
+		zeroFields,
+		time.Now(),
+	),
+	testutil.MustMetric(
+		"nfs",
+		map[string]string{"nfsVersion": "v3", "op_family": "nfs", "role": "server"},
+		zeroFields,
+		time.Now(),
+	),
+	testutil.MustMetric(
+		"nfs",
+		map[string]string{"nfsVersion": "v4", "op_family": "nfs", "role": "server"},
+		zeroFields,
+		time.Now(),
+	),
+}
+
+var svcPoolOutput = `SVCPOOL = ffffff0d2b6f7c00 -> POOL ID = NFS(1)
+Non detached threads    = 16
+Detached threads        = 2
+Max threads             = 1024
+` + "`redline'" + `               = 1
+Reserved threads        = 0
+Thread lock     = mutex not held
+Asleep threads          = 15
+Request lock    = mutex not held
+Pending requests        = 2
+Walking threads         = 0
+Max requests from xprt  = 8
+Stack size for svc_run  = 0
+Creator lock    = mutex not held
+No of Master xprt's     = 4
+rwlock for the mxprtlist= owner 0
+master xprt list ptr    = ffffff0d2b52e9c8`
+
+var rfs4DbOutput = `rfs4_database=ffffff0d0e8ea8c0
+    debug_flags=00000000  shutdown: count=0 tables=ffffff0d0fa3e5c0
+------------------ Table ------------------- Bkt  ------- Indices -------
+Address          Name         Flags    Cnt  Cnt  Pointer          Cnt  Max
+ffffff0d0fa3e5c0 DelegStateID 00000000 4    2047 ffffff0d0fa41d40 2    2
+ffffff0d0fa3e3c0 File         00000000 9    2047 ffffff0d0fa41bc0 1    1
+ffffff0d0fa3e1c0 LockStateID  00000000 0    2047 ffffff0d0fa41a40 2    2
+ffffff0d0fa3dfc0 Lockowner    00000000 0    2047 ffffff0d0fa418c0 2    2
+ffffff0d0fa3ddc0 OpenStateID  00000000 17   2047 ffffff0d0fa41740 3    3
+ffffff0d0fa3dbc0 OpenOwner    00000000 31   2047 ffffff0d0fa415c0 1    1
+ffffff0d0fa3d9c0 ClientIP     00000000 12   2047 ffffff0d0fa41440 1    1
+ffffff0d0fa3d7c0 Client       00000000 12   2047 ffffff0d0fa412c0 2    2`
@@ -0,0 +1,117 @@
+package illumos_nfs
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nfsMount is an NFS filesystem mounted on this host.
+type nfsMount struct {
+	resource   string
+	mountpoint string
+}
+
+// probeResult is the outcome of statvfs(2)-ing a single mount.
+type probeResult struct {
+	mount      nfsMount
+	responsive bool
+	latency    time.Duration
+}
+
+// mountProber runs statvfs(2) probes against NFS mounts. A probe of a hung hard mount may never
+// return, so each one runs in its own goroutine, and we only wait as long as the timeout. A mount
+// whose last probe is still stuck is reported as unresponsive without being probed again, so hung
+// mounts do not pile up goroutines.
+type mountProber struct {
+	sync.Mutex
+	inFlight map[string]bool
+}
+
+var mnttabContents = func() string {
+	raw, err := ioutil.ReadFile("/etc/mnttab")
+
+	if err != nil {
+		log.Printf("cannot read mnttab: %v", err)
+	}
+
+	return string(raw)
+}
+
+var statvfs = func(path string) error {
+	var buf unix.Statvfs_t
+	return unix.Statvfs(path, &buf)
+}
+
+func newMountProber() *mountProber {
+	return &mountProber{inFlight: make(map[string]bool)}
+}
+
+// parseMnttab picks the NFS mounts out of mnttab(4). Each line is tab-separated, with the
+// resource, the mount point and the filesystem type first.
+func parseMnttab(raw string) []nfsMount {
+	var ret []nfsMount
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.Split(line, "\t")
+
+		if len(chunks) < 3 || chunks[2] != "nfs" {
+			continue
+		}
+
+		ret = append(ret, nfsMount{resource: chunks[0], mountpoint: chunks[1]})
+	}
+
+	return ret
+}
+
+// probeAll probes every mount at once, and returns when they have all answered or timed out.
+func (p *mountProber) probeAll(mounts []nfsMount, timeout time.Duration) []probeResult {
+	results := make(chan probeResult, len(mounts))
+
+	for _, mount := range mounts {
+		go p.probe(mount, timeout, results)
+	}
+
+	ret := make([]probeResult, 0, len(mounts))
+
+	for range mounts {
+		ret = append(ret, <-results)
+	}
+
+	return ret
+}
+
+func (p *mountProber) probe(mount nfsMount, timeout time.Duration, results chan<- probeResult) {
+	p.Lock()
+
+	if p.inFlight[mount.mountpoint] {
+		p.Unlock()
+		results <- probeResult{mount: mount, responsive: false, latency: timeout}
+		return
+	}
+
+	p.inFlight[mount.mountpoint] = true
+	p.Unlock()
+
+	done := make(chan error, 1)
+	start := time.Now()
+
+	go func() {
+		err := statvfs(mount.mountpoint)
+		p.Lock()
+		delete(p.inFlight, mount.mountpoint)
+		p.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		results <- probeResult{mount: mount, responsive: err == nil, latency: time.Since(start)}
+	case <-time.After(timeout):
+		results <- probeResult{mount: mount, responsive: false, latency: timeout}
+	}
+}
@@ -0,0 +1,101 @@
+package illumos_nfs
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseMnttab(t *testing.T) {
+	assert.Equal(
+		t,
+		[]nfsMount{
+			{resource: "tornado:/export/home", mountpoint: "/home/rob"},
+			{resource: "tornado:/data/media", mountpoint: "/storage/media"},
+		},
+		parseMnttab(mnttabSample))
+
+	assert.Nil(t, parseMnttab(""))
+}
+
+func TestProbeAll(t *testing.T) {
+	hang := make(chan struct{})
+	var calls sync.Map
+
+	statvfs = func(path string) error {
+		n, _ := calls.LoadOrStore(path, 0)
+		calls.Store(path, n.(int)+1)
+
+		switch path {
+		case "/hung":
+			<-hang
+		case "/stale":
+			return errors.New("stale NFS file handle")
+		}
+
+		return nil
+	}
+
+	mounts := []nfsMount{
+		{resource: "a:/ok", mountpoint: "/ok"},
+		{resource: "a:/hung", mountpoint: "/hung"},
+		{resource: "a:/stale", mountpoint: "/stale"},
+	}
+
+	p := newMountProber()
+	timeout := 50 * time.Millisecond
+
+	start := time.Now()
+	results := sortedResults(p.probeAll(mounts, timeout))
+	assert.True(t, time.Since(start) < 10*timeout)
+
+	assert.Equal(t, "/hung", results[0].mount.mountpoint)
+	assert.False(t, results[0].responsive)
+	assert.Equal(t, timeout, results[0].latency)
+	assert.Equal(t, "/ok", results[1].mount.mountpoint)
+	assert.True(t, results[1].responsive)
+	assert.Equal(t, "/stale", results[2].mount.mountpoint)
+	assert.False(t, results[2].responsive)
+
+	// The first probe of /hung is still stuck, so it must not be probed again.
+	results = sortedResults(p.probeAll(mounts, timeout))
+	assert.False(t, results[0].responsive)
+	hungCalls, _ := calls.Load("/hung")
+	assert.Equal(t, 1, hungCalls)
+	okCalls, _ := calls.Load("/ok")
+	assert.Equal(t, 2, okCalls)
+
+	// Once it comes back, it is probed as normal.
+	close(hang)
+
+	for i := 0; i < 100; i++ {
+		p.Lock()
+		stuck := p.inFlight["/hung"]
+		p.Unlock()
+
+		if !stuck {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	results = sortedResults(p.probeAll(mounts, timeout))
+	assert.True(t, results[0].responsive)
+}
+
+func sortedResults(results []probeResult) []probeResult {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].mount.mountpoint < results[j].mount.mountpoint
+	})
+
+	return results
+}
+
+var mnttabSample = "rpool/ROOT/omnios\t/\tzfs\tdev=4750002\t1619012345\n" +
+	"tornado:/export/home\t/home/rob\tnfs\txattr,dev=8a40001\t1619012399\n" +
+	"swap\t/tmp\ttmpfs\txattr,dev=4a80002\t1619012350\n" +
+	"tornado:/data/media\t/storage/media\tnfs\tro,xattr,dev=8a40002\t1619012400\n"
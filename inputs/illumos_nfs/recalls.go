@@ -0,0 +1,132 @@
+package illumos_nfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// recallScript prints a line each time the NFSv4 server sends a client a CB_RECALL, asking for a
+// delegation back.
+const recallScript = `nfsv4:::cb-recall-start { printf("recall\n"); }`
+
+// recallWatcher counts delegation recalls. The kernel keeps no count we can read, so we leave a
+// DTrace running in the background, and count the lines it prints. If DTrace exits, we remember
+// why, and report that instead of a count. We don't start it again, because whatever stopped it,
+// usually missing privileges or a kernel without the nfsv4 provider, will most likely stop it
+// again.
+type recallWatcher struct {
+	sync.Mutex
+	count   int
+	running bool
+	closed  bool
+	err     error
+	kill    func()
+}
+
+// recallTrace is a running DTrace. wait must only be called once out has been read to the end.
+type recallTrace struct {
+	out  io.Reader
+	wait func() error
+	kill func()
+}
+
+// startRecallTrace starts DTrace. Its standard error is kept, so we can say why it exited.
+var startRecallTrace = func() (*recallTrace, error) {
+	cmd := exec.Command("/bin/pfexec", "/usr/sbin/dtrace", "-q", "-n", recallScript)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &recallTrace{
+		out: out,
+		wait: func() error {
+			err := cmd.Wait()
+			msg := strings.TrimSpace(stderr.String())
+
+			if err == nil {
+				return fmt.Errorf("DTrace exited: %s", msg)
+			}
+
+			return fmt.Errorf("DTrace exited: %v: %s", err, msg)
+		},
+		kill: func() { _ = cmd.Process.Kill() },
+	}, nil
+}
+
+// recalls makes sure the DTrace is running, and returns the number of recalls it has seen. There
+// is no count on the collection which starts it, because we don't yet know whether it will keep
+// running. If it has exited, we return the reason.
+func (w *recallWatcher) recalls() (int, bool, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.err != nil {
+		return 0, false, w.err
+	}
+
+	if w.running {
+		return w.count, true, nil
+	}
+
+	trace, err := startRecallTrace()
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	w.running = true
+	w.kill = trace.kill
+	go w.watch(trace)
+
+	return 0, false, nil
+}
+
+// watch counts the recalls DTrace reports, until it exits. It is the only thing which waits for
+// DTrace.
+func (w *recallWatcher) watch(trace *recallTrace) {
+	scanner := bufio.NewScanner(trace.out)
+
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "recall" {
+			w.Lock()
+			w.count++
+			w.Unlock()
+		}
+	}
+
+	err := trace.wait()
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.running = false
+
+	if !w.closed {
+		w.err = err
+	}
+}
+
+// close kills the DTrace, if it is running. The watch goroutine sees it exit, and cleans up.
+func (w *recallWatcher) close() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.closed = true
+
+	if w.running {
+		w.kill()
+	}
+}
@@ -0,0 +1,169 @@
+package illumos_nfs
+
+import (
+	"errors"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRecallWatcher(t *testing.T) {
+	starts := 0
+	trace, write := fakeRecallTrace(nil)
+
+	startRecallTrace = func() (*recallTrace, error) {
+		starts++
+		return trace, nil
+	}
+
+	w := &recallWatcher{}
+	_, counting, err := w.recalls()
+	require.NoError(t, err)
+	assert.False(t, counting)
+
+	write("recall\nrecall\n\nrecall\n")
+
+	require.Eventually(t, func() bool {
+		w.Lock()
+		defer w.Unlock()
+		return w.count == 3
+	}, time.Second, time.Millisecond)
+
+	count, counting, err := w.recalls()
+	require.NoError(t, err)
+	assert.True(t, counting)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 1, starts)
+
+	// Killing DTrace on the way out is not an error
+	w.close()
+
+	require.Eventually(t, func() bool {
+		w.Lock()
+		defer w.Unlock()
+		return !w.running
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(t, w.err)
+}
+
+func TestRecallWatcherExits(t *testing.T) {
+	starts := 0
+	trace, _ := fakeRecallTrace(errors.New("DTrace exited: exit status 1: dtrace: failed to initialize"))
+
+	startRecallTrace = func() (*recallTrace, error) {
+		starts++
+		return trace, nil
+	}
+
+	w := &recallWatcher{}
+	_, _, err := w.recalls()
+	require.NoError(t, err)
+	trace.kill()
+
+	require.Eventually(t, func() bool {
+		w.Lock()
+		defer w.Unlock()
+		return !w.running
+	}, time.Second, time.Millisecond)
+
+	// The reason is reported on every collection, and DTrace is not started again
+	for i := 0; i < 2; i++ {
+		_, counting, err := w.recalls()
+		assert.EqualError(t, err, "DTrace exited: exit status 1: dtrace: failed to initialize")
+		assert.False(t, counting)
+	}
+
+	assert.Equal(t, 1, starts)
+}
+
+func TestRecallWatcherCannotStart(t *testing.T) {
+	startRecallTrace = func() (*recallTrace, error) {
+		return nil, errors.New("no dtrace")
+	}
+
+	w := &recallWatcher{}
+	_, counting, err := w.recalls()
+	assert.Error(t, err)
+	assert.False(t, counting)
+	assert.False(t, w.running)
+	w.close()
+}
+
+func TestGatherV4State(t *testing.T) {
+	mdbOutput = func(dcmd string) string {
+		assert.Equal(t, "::rfs4_db", dcmd)
+		return rfs4DbOutput
+	}
+
+	trace, write := fakeRecallTrace(nil)
+	killed := false
+	kill := trace.kill
+
+	trace.kill = func() {
+		killed = true
+		kill()
+	}
+
+	startRecallTrace = func() (*recallTrace, error) {
+		return trace, nil
+	}
+
+	s := &IllumosNfs{V4State: true}
+	acc := testutil.Accumulator{}
+	s.gatherV4State(&acc)
+
+	// There is no recall count on the first collection
+	assert.True(t, acc.HasPoint("nfs.v4state", map[string]string{"role": "server"}, "clients", 12))
+	assert.False(t, acc.HasField("nfs.v4state", "delegations_recalled"))
+
+	write("recall\n")
+
+	require.Eventually(t, func() bool {
+		s.recalls.Lock()
+		defer s.recalls.Unlock()
+		return s.recalls.count == 1
+	}, time.Second, time.Millisecond)
+
+	acc.ClearMetrics()
+	s.gatherV4State(&acc)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"nfs.v4state",
+				map[string]string{"role": "server"},
+				map[string]interface{}{
+					"clients":              12,
+					"open_owners":          31,
+					"delegations":          4,
+					"delegations_recalled": 1,
+				},
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+
+	s.Stop()
+	assert.True(t, killed)
+}
+
+// fakeRecallTrace is a recallTrace whose output is whatever is passed to the function it returns.
+// Killing it ends the output, and waiting for it returns exitErr.
+func fakeRecallTrace(exitErr error) (*recallTrace, func(string)) {
+	r, w := io.Pipe()
+
+	return &recallTrace{
+		out:  r,
+		wait: func() error { return exitErr },
+		kill: func() { w.Close() },
+	}, func(out string) {
+		_, _ = w.Write([]byte(out))
+	}
+}
@@ -0,0 +1,341 @@
+package illumos_nfs_latency
+
+import (
+	"context"
+	"fmt"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	sh "github.com/snltd/solaris-telegraf-helpers"
+	"log"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sampleConfig = `
+	## How long each DTrace run samples for. It is capped at half the collection interval.
+	# duration = "5s"
+	## The NFS versions you wish to trace
+	# nfs_versions = ["v3", "v4"]
+	## The operations you wish to report. Specifying none reports all.
+	# ops = ["read", "write", "getattr", "lookup", "access"]
+	## Whether to break latency down by file, as well as by operation and client. This can create
+	## a great many series.
+	# per_file = false
+	## The latency percentiles you wish to report
+	# percentiles = [50.0, 90.0, 99.0]
+`
+
+func (s *IllumosNfsLatency) Description() string {
+	return "Reports NFS server operation latency, using DTrace"
+}
+
+func (s *IllumosNfsLatency) SampleConfig() string {
+	return sampleConfig
+}
+
+type IllumosNfsLatency struct {
+	Duration    config.Duration
+	NfsVersions []string
+	Ops         []string
+	PerFile     bool
+	Percentiles []float64
+	// lastGather is when Gather last ran, so we can measure the collection interval.
+	lastGather time.Time
+}
+
+// opLatency is the latency distribution of a single operation, from a single client, to a single
+// file if we are tracing per file. Times are in nanoseconds.
+type opLatency struct {
+	version string
+	op      string
+	client  string
+	file    string
+	count   uint64
+	sum     uint64
+	buckets []bucket
+}
+
+// bucket is a line of a quantize() histogram. It counts values from value up to, but not
+// including, the value of the next power of two.
+type bucket struct {
+	value int64
+	count uint64
+}
+
+const defaultDuration = 5 * time.Second
+
+var defaultPercentiles = []float64{50, 90, 99}
+
+// nfsProviders maps the NFS versions we can trace to their DTrace providers.
+var nfsProviders = map[string]string{
+	"v3": "nfsv3",
+	"v4": "nfsv4",
+}
+
+// The D script keys every aggregation on provider, operation, client and file, and printa()s them
+// one after the other, tab-separated, followed by the quantize() histogram. The file is "-" unless
+// we're tracing per file.
+var dScript = `
+%[1]s
+{
+	self->ts[probeprov, args[1]->noi_xid] = timestamp;
+}
+
+%[2]s
+/self->ts[probeprov, args[1]->noi_xid]/
+{
+	this->lat = timestamp - self->ts[probeprov, args[1]->noi_xid];
+	this->op = substr(probename, 3, strlen(probename) - 8);
+	@c[probeprov, this->op, args[0]->ci_remote, %[3]s] = count();
+	@s[probeprov, this->op, args[0]->ci_remote, %[3]s] = sum(this->lat);
+	@q[probeprov, this->op, args[0]->ci_remote, %[3]s] = quantize(this->lat);
+	self->ts[probeprov, args[1]->noi_xid] = 0;
+}
+
+tick-%[4]dms
+{
+	printa("%%s\t%%s\t%%s\t%%s\t%%@d\t%%@d\n%%@d\n", @c, @s, @q);
+	exit(0);
+}
+`
+
+// A quantize() histogram line looks like "   65536 |@@@@@@@@@@@@       81".
+var histogramLine = regexp.MustCompile(`^\s*(-?[0-9]+)\s+\|[@ ]*\s([0-9]+)\s*$`)
+
+var now = time.Now
+
+// dtraceOutput runs a D script, and kills it if it overruns.
+var dtraceOutput = func(script string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(
+		ctx, "/bin/pfexec", "/usr/sbin/dtrace", "-q", "-n", script).Output()
+
+	return string(out), err
+}
+
+func (s *IllumosNfsLatency) Gather(acc telegraf.Accumulator) error {
+	duration := s.sampleDuration()
+	raw, err := dtraceOutput(s.script(duration), 2*duration)
+
+	if err != nil {
+		return fmt.Errorf("cannot run DTrace: %v", err)
+	}
+
+	latencies, err := parseDtrace(raw)
+
+	if err != nil {
+		return err
+	}
+
+	percentiles := s.Percentiles
+
+	if len(percentiles) == 0 {
+		percentiles = defaultPercentiles
+	}
+
+	for _, lat := range latencies {
+		if !sh.WeWant(lat.op, s.Ops) {
+			continue
+		}
+
+		tags := map[string]string{
+			"nfsVersion": lat.version,
+			"op":         lat.op,
+			"client":     lat.client,
+		}
+
+		if s.PerFile {
+			tags["file"] = lat.file
+		}
+
+		acc.AddFields("nfs.latency", latencyFields(lat, percentiles), tags)
+	}
+
+	return nil
+}
+
+// sampleDuration works out how long to trace for. Telegraf doesn't tell an input its collection
+// interval, so we measure it as the time since the previous Gather, and cap the duration at half
+// of it. That leaves the same again for DTrace to finish before the next collection is due.
+func (s *IllumosNfsLatency) sampleDuration() time.Duration {
+	duration := time.Duration(s.Duration)
+
+	if duration <= 0 {
+		duration = defaultDuration
+	}
+
+	t := now()
+
+	if !s.lastGather.IsZero() {
+		if limit := t.Sub(s.lastGather) / 2; duration > limit {
+			log.Printf("NFS latency duration %s is too long for the interval: using %s", duration, limit)
+			duration = limit
+		}
+	}
+
+	s.lastGather = t
+	return duration
+}
+
+// script writes a D script which traces the operations of the NFS versions we want, for the given
+// time.
+func (s *IllumosNfsLatency) script(duration time.Duration) string {
+	var versions []string
+
+	for version := range nfsProviders {
+		if sh.WeWant(version, s.NfsVersions) {
+			versions = append(versions, version)
+		}
+	}
+
+	sort.Strings(versions)
+
+	var starts, dones []string
+
+	for _, version := range versions {
+		starts = append(starts, fmt.Sprintf("%s:::op-*-start", nfsProviders[version]))
+		dones = append(dones, fmt.Sprintf("%s:::op-*-done", nfsProviders[version]))
+	}
+
+	file := `"-"`
+
+	if s.PerFile {
+		file = "args[1]->noi_curpath"
+	}
+
+	return fmt.Sprintf(
+		dScript,
+		strings.Join(starts, ",\n"),
+		strings.Join(dones, ",\n"),
+		file,
+		duration.Milliseconds())
+}
+
+// parseDtrace turns the printa() output of the D script into a list of opLatencys.
+func parseDtrace(raw string) ([]opLatency, error) {
+	var ret []opLatency
+	var current *opLatency
+
+	for _, line := range strings.Split(raw, "\n") {
+		if strings.TrimSpace(line) == "" || strings.Contains(line, "Distribution") {
+			continue
+		}
+
+		if chunks := strings.Split(line, "\t"); len(chunks) == 6 {
+			lat, err := parseKeyLine(chunks)
+
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, lat)
+			current = &ret[len(ret)-1]
+			continue
+		}
+
+		match := histogramLine.FindStringSubmatch(line)
+
+		if match == nil || current == nil {
+			return nil, fmt.Errorf("cannot parse DTrace output: %s", line)
+		}
+
+		value, _ := strconv.ParseInt(match[1], 10, 64)
+		count, _ := strconv.ParseUint(match[2], 10, 64)
+		current.buckets = append(current.buckets, bucket{value: value, count: count})
+	}
+
+	return ret, nil
+}
+
+// parseKeyLine reads the tab-separated aggregation keys, count and sum which head each record.
+func parseKeyLine(chunks []string) (opLatency, error) {
+	count, err := strconv.ParseUint(chunks[4], 10, 64)
+
+	if err != nil {
+		return opLatency{}, fmt.Errorf("cannot parse DTrace count: %s", chunks[4])
+	}
+
+	sum, err := strconv.ParseUint(chunks[5], 10, 64)
+
+	if err != nil {
+		return opLatency{}, fmt.Errorf("cannot parse DTrace sum: %s", chunks[5])
+	}
+
+	return opLatency{
+		version: strings.TrimPrefix(chunks[0], "nfs"),
+		op:      chunks[1],
+		client:  chunks[2],
+		file:    chunks[3],
+		count:   count,
+		sum:     sum,
+	}, nil
+}
+
+// latencyFields turns an opLatency into count, mean and percentile fields. Latencies are reported
+// in microseconds.
+func latencyFields(lat opLatency, percentiles []float64) map[string]interface{} {
+	fields := map[string]interface{}{"count": lat.count}
+
+	if lat.count == 0 {
+		return fields
+	}
+
+	fields["mean_us"] = float64(lat.sum) / float64(lat.count) / 1000
+
+	for _, p := range percentiles {
+		fields[fmt.Sprintf("p%s_us", strconv.FormatFloat(p, 'f', -1, 64))] =
+			percentile(lat.buckets, p) / 1000
+	}
+
+	return fields
+}
+
+// percentile estimates the given percentile of a quantize() histogram. quantize() only tells us
+// which power-of-two bucket each value fell into, so we assume values are spread evenly through
+// the bucket.
+func percentile(buckets []bucket, p float64) float64 {
+	var total uint64
+
+	for _, b := range buckets {
+		total += b.count
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	target := p / 100 * float64(total)
+	var seen float64
+
+	for _, b := range buckets {
+		if b.count == 0 {
+			continue
+		}
+
+		if seen+float64(b.count) >= target {
+			lower := float64(b.value)
+			upper := lower * 2
+
+			if b.value <= 0 {
+				upper = lower + 1
+			}
+
+			return lower + (target-seen)/float64(b.count)*(upper-lower)
+		}
+
+		seen += float64(b.count)
+	}
+
+	return float64(buckets[len(buckets)-1].value)
+}
+
+func init() {
+	inputs.Add("illumos_nfs_latency", func() telegraf.Input { return &IllumosNfsLatency{} })
+}
@@ -0,0 +1,214 @@
+package illumos_nfs_latency
+
+import (
+	"errors"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlugin(t *testing.T) {
+	s := &IllumosNfsLatency{
+		Duration:    config.Duration(5 * time.Second),
+		Ops:         []string{"read", "getattr"},
+		Percentiles: []float64{50, 99},
+	}
+
+	dtraceOutput = func(script string, timeout time.Duration) (string, error) {
+		assert.Equal(t, 10*time.Second, timeout)
+		assert.Contains(t, script, "tick-5000ms")
+		return sampleOutput, nil
+	}
+
+	acc := testutil.Accumulator{}
+	require.NoError(t, s.Gather(&acc))
+	require.Len(t, acc.Metrics, 2)
+
+	// Percentiles are estimates, so compare them approximately.
+	for _, m := range acc.Metrics {
+		assert.Equal(t, "nfs.latency", m.Measurement)
+		assert.NotContains(t, m.Tags, "file")
+		expected := expectedFields[m.Tags["op"]]
+		require.NotNil(t, expected, m.Tags["op"])
+		assert.Len(t, m.Fields, len(expected))
+
+		for field, val := range expected {
+			assert.InDelta(t, val, m.Fields[field], 1e-6, field)
+		}
+	}
+
+	assert.True(t, acc.HasPoint(
+		"nfs.latency",
+		map[string]string{"nfsVersion": "v3", "op": "read", "client": "192.168.1.21"},
+		"count",
+		uint64(120)))
+}
+
+func TestPluginDtraceFails(t *testing.T) {
+	s := &IllumosNfsLatency{}
+
+	dtraceOutput = func(script string, timeout time.Duration) (string, error) {
+		return "", errors.New("exit status 1")
+	}
+
+	acc := testutil.Accumulator{}
+	assert.Error(t, s.Gather(&acc))
+}
+
+func TestSampleDuration(t *testing.T) {
+	clock := time.Unix(1618958834, 0)
+	now = func() time.Time { return clock }
+
+	s := &IllumosNfsLatency{}
+	assert.Equal(t, defaultDuration, s.sampleDuration())
+
+	clock = clock.Add(60 * time.Second)
+	assert.Equal(t, defaultDuration, s.sampleDuration())
+
+	// A duration longer than half the interval is cut down to fit.
+	s.Duration = config.Duration(45 * time.Second)
+	clock = clock.Add(60 * time.Second)
+	assert.Equal(t, 30*time.Second, s.sampleDuration())
+
+	clock = clock.Add(8 * time.Second)
+	s.Duration = 0
+	assert.Equal(t, 4*time.Second, s.sampleDuration())
+}
+
+func TestScript(t *testing.T) {
+	all := (&IllumosNfsLatency{}).script(10 * time.Second)
+	assert.Contains(t, all, "nfsv3:::op-*-start,\nnfsv4:::op-*-start")
+	assert.Contains(t, all, "nfsv3:::op-*-done,\nnfsv4:::op-*-done")
+	assert.Contains(t, all, `args[0]->ci_remote, "-"] = count()`)
+	assert.Contains(t, all, "tick-10000ms")
+	assert.Contains(t, all, `printa("%s\t%s\t%s\t%s\t%@d\t%@d\n%@d\n", @c, @s, @q);`)
+
+	v3 := (&IllumosNfsLatency{NfsVersions: []string{"v3"}, PerFile: true}).script(time.Second)
+	assert.NotContains(t, v3, "nfsv4")
+	assert.Contains(t, v3, "args[0]->ci_remote, args[1]->noi_curpath] = count()")
+}
+
+func TestParseDtrace(t *testing.T) {
+	latencies, err := parseDtrace(sampleOutput)
+	require.NoError(t, err)
+	require.Len(t, latencies, 3)
+
+	assert.Equal(
+		t,
+		opLatency{
+			version: "v3",
+			op:      "read",
+			client:  "192.168.1.21",
+			file:    "-",
+			count:   120,
+			sum:     10240000,
+			buckets: []bucket{
+				{value: 16384, count: 0},
+				{value: 32768, count: 27},
+				{value: 65536, count: 81},
+				{value: 131072, count: 12},
+				{value: 262144, count: 0},
+			},
+		},
+		latencies[1])
+
+	_, err = parseDtrace("nfsv3\tread\t192.168.1.21\t-\tmany\t10\n")
+	assert.Error(t, err)
+
+	_, err = parseDtrace("dtrace: failed to initialize dtrace: DTrace requires additional privileges")
+	assert.Error(t, err)
+
+	latencies, err = parseDtrace("")
+	assert.NoError(t, err)
+	assert.Empty(t, latencies)
+}
+
+func TestPercentile(t *testing.T) {
+	buckets := []bucket{
+		{value: 1024, count: 0},
+		{value: 2048, count: 50},
+		{value: 4096, count: 50},
+		{value: 8192, count: 0},
+	}
+
+	assert.Equal(t, 2048.0, percentile(buckets, 0))
+	assert.Equal(t, 4096.0, percentile(buckets, 50))
+	assert.Equal(t, 6144.0, percentile(buckets, 75))
+	assert.Equal(t, 8192.0, percentile(buckets, 100))
+	assert.Equal(t, 0.0, percentile([]bucket{}, 50))
+}
+
+func TestLatencyFields(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]interface{}{
+			"count":    uint64(100),
+			"mean_us":  3.5,
+			"p50_us":   4.096,
+			"p99.9_us": 8.183808,
+		},
+		latencyFields(
+			opLatency{
+				count: 100,
+				sum:   350000,
+				buckets: []bucket{
+					{value: 2048, count: 50},
+					{value: 4096, count: 50},
+				},
+			},
+			[]float64{50, 99.9}))
+
+	assert.Equal(
+		t,
+		map[string]interface{}{"count": uint64(0)},
+		latencyFields(opLatency{}, []float64{50}))
+}
+
+// Captured from 'dtrace -q -n' running the plugin's script on an OmniOS NFS server.
+var sampleOutput = strings.Join([]string{
+	"nfsv4\tgetattr\t192.168.1.30\t-\t4\t26624",
+	"",
+	"           value  ------------- Distribution ------------- count    ",
+	"            2048 |                                         0        ",
+	"            4096 |@@@@@@@@@@@@@@@@@@@@                     2        ",
+	"            8192 |@@@@@@@@@@@@@@@@@@@@                     2        ",
+	"           16384 |                                         0        ",
+	"",
+	"nfsv3\tread\t192.168.1.21\t-\t120\t10240000",
+	"",
+	"           value  ------------- Distribution ------------- count    ",
+	"           16384 |                                         0        ",
+	"           32768 |@@@@@@@@@                                27       ",
+	"           65536 |@@@@@@@@@@@@@@@@@@@@@@@@@@@              81       ",
+	"          131072 |@@@@                                     12       ",
+	"          262144 |                                         0        ",
+	"",
+	"nfsv3\twrite\t192.168.1.21\t-\t9\t3096576",
+	"",
+	"           value  ------------- Distribution ------------- count    ",
+	"          131072 |                                         0        ",
+	"          262144 |@@@@@@@@@@@@@@@@@@@@@@@@@@@              6        ",
+	"          524288 |@@@@@@@@@@@@@                            3        ",
+	"         1048576 |                                         0        ",
+	"",
+}, "\n")
+
+// expectedFields are the fields we expect for each operation in sampleOutput, once filtered.
+var expectedFields = map[string]map[string]float64{
+	"getattr": {
+		"count":   4,
+		"mean_us": 6.656,
+		"p50_us":  8.192,
+		"p99_us":  16.22016,
+	},
+	"read": {
+		"count":   120,
+		"mean_us": 85.333333,
+		"p50_us":  92.235852,
+		"p99_us":  249.0368,
+	},
+}
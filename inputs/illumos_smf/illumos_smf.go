@@ -1,10 +1,18 @@
 package illumos_smf
 
 import (
+	"fmt"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	sth "github.com/snltd/solaris-telegraf-helpers"
+	"github.com/snltd/solaris-telegraf-plugins/internal/helpers"
+	"hash/fnv"
+	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var sampleConfig = `
@@ -15,12 +23,87 @@ var sampleConfig = `
 	## Whether or not you wish to generate individual, detailed points for services which are in
 	## SvcStates but are not "online"
 	# generate_details = true
+	## Services you always want a point for, whatever state they are in. Globs are allowed.
+	# watch = ["svc:/network/http:*", "svc:/site/*"]
+	## Whether to add the explanation from 'svcs -xv' to the detailed points
+	# explain = false
+	## Whether to add to the detailed points the number of services which depend, directly or
+	## indirectly, on each service
+	# impact = false
+	## Whether to report how long each service has been in its current state
+	# time_in_state = false
+	## Whether to emit a point each time a service changes state, and to count how often each
+	## service has changed state recently
+	# transitions = false
+	## How far back to look when counting state changes
+	# flap_window = "1h"
+	## Whether to count the times svc.startd restarts each service, by watching its contract ID
+	# restarts = false
+	## Whether to also report the time of each service's most recent restart
+	# restart_time = false
+	## Whether to report, for each zone, whether it has finished booting
+	# boot_readiness = false
+	## When a service goes into maintenance, send this many lines from the end of its log. 0 is off
+	# log_lines = 0
+	## Whether to send SMF property values as tags rather than fields
+	# property_tags = false
+	## SMF properties to report, keyed by FMRI. Globs are allowed in the FMRI
+	# [inputs.illumos_smf.properties]
+	#   "svc:/network/http:*" = ["config/port", "start/timeout_seconds", "general/enabled"]
+	## Services which should be enabled or disabled in zones matching the given globs. Services
+	## which differ are counted as drift
+	# [[inputs.illumos_smf.desired]]
+	#   zones = ["*"]
+	#   enabled = ["svc:/network/ssh:default"]
+	#   disabled = ["svc:/network/telnet:default"]
 `
 
 type IllumosSmf struct {
 	SvcStates       []string
 	Zones           []string
 	GenerateDetails bool
+	Watch           []string
+	Explain         bool
+	Impact          bool
+	TimeInState     bool
+	Transitions     bool
+	FlapWindow      config.Duration
+	Restarts        bool
+	RestartTime     bool
+	BootReadiness   bool
+	LogLines        int
+	Properties      map[string][]string
+	PropertyTags    bool
+	Desired         []desiredState
+	// lastStates is the state of every service when we last looked.
+	lastStates map[svcKey]string
+	// changes holds the times at which each service recently changed state.
+	changes map[svcKey][]time.Time
+	// ctids is the contract ID of every service when we last looked.
+	ctids map[svcKey]string
+	// restarts holds the number of restarts we have seen for each service, and when the last one
+	// was.
+	restarts map[svcKey]svcRestarts
+	// maintenance holds every service which was in maintenance when we last looked.
+	maintenance map[svcKey]bool
+}
+
+type svcRestarts struct {
+	count int
+	last  time.Time
+}
+
+// svc is a single line of svcs(1) output.
+type svc struct {
+	zone  string
+	state string
+	fmri  string
+}
+
+// svcKey identifies a service instance across the whole host.
+type svcKey struct {
+	zone string
+	fmri string
 }
 
 type svcSummary struct {
@@ -40,8 +123,54 @@ type svcErr struct {
 	fmri  string
 }
 
+// dependencyCache holds the dependency graph of each zone we have looked at in this collection, so
+// each zone's services are only listed once.
+type dependencyCache map[string]svcGraph
+
+// svcGraph holds the dependencies between the service instances in a zone. Both maps are keyed by
+// instance FMRI.
+type svcGraph struct {
+	dependencies map[string][]string
+	dependents   map[string][]string
+}
+
+// desiredState says which services should be enabled, and which disabled, in a set of zones.
+type desiredState struct {
+	Zones    []string
+	Enabled  []string
+	Disabled []string
+}
+
+// desiredService is a service pattern, and whether services matching it should be enabled.
+type desiredService struct {
+	pattern string
+	enabled bool
+}
+
+// svcProperty is a single property from svcprop(1).
+type svcProperty struct {
+	kind  string
+	value string
+}
+
+// svcExplanation is what 'svcs -xv' has to say about a service which is not running properly.
+type svcExplanation struct {
+	reason     string
+	log        string
+	manpage    string
+	dependents int
+}
+
 const externalCmd = "/bin/svcs -aHZ -ozone,state,fmri"
 
+// ngzCmd is used in a non-global zone, where svcs(1) does not understand -Z.
+const ngzCmd = "/bin/svcs -aH -ostate,fmri"
+
+const defaultFlapWindow = time.Hour
+
+// readyMilestone is the milestone a zone reaches when it has finished booting.
+const readyMilestone = "svc:/milestone/multi-user-server:default"
+
 func (s *IllumosSmf) Description() string {
 	return "Aggregates the states of SMF services across a host."
 }
@@ -50,12 +179,76 @@ func (s *IllumosSmf) SampleConfig() string {
 	return sampleConfig
 }
 
+// zoneName is the zone in which Telegraf is running.
+var zoneName = ""
+
 var rawOutput = func() string {
+	if inNgz() {
+		return sth.RunCmd(ngzCmd)
+	}
+
 	return sth.RunCmd(externalCmd)
 }
 
+var svcsExplainOutput = func(zone string) string {
+	return sth.RunCmd("/bin/svcs -xv" + zoneFlag(zone))
+}
+
+var ctidOutput = func() string {
+	if inNgz() {
+		return sth.RunCmd("/bin/svcs -aH -octid,fmri")
+	}
+
+	return sth.RunCmd("/bin/svcs -aHZ -ozone,ctid,fmri")
+}
+
+var stateTimestampOutput = func(zone string) string {
+	return sth.RunCmd(
+		fmt.Sprintf("/usr/bin/svcprop -f%s -p restarter/state_timestamp *", zoneFlag(zone)))
+}
+
+var svcsLongOutput = func(zone string) string {
+	return sth.RunCmd(fmt.Sprintf("/bin/svcs%s -l *", zoneFlag(zone)))
+}
+
+var propertyGroupOutput = func(zone, fmri, pg string) string {
+	return sth.RunCmd(fmt.Sprintf("/usr/bin/svcprop%s -p %s %s", zoneFlag(zone), pg, fmri))
+}
+
+var enabledPropertyOutput = func(zone, fmri string) string {
+	return sth.RunCmd(fmt.Sprintf("/usr/bin/svcprop%s -p general/enabled %s", zoneFlag(zone), fmri))
+}
+
+var milestoneTimeOutput = func(zone string) string {
+	return sth.RunCmd(fmt.Sprintf("/usr/bin/svcprop%s -p restarter/state_timestamp %s",
+		zoneFlag(zone), readyMilestone))
+}
+
+var zoneBootTimes = helpers.ZoneBootTimes
+
+var logPathOutput = func(zone, fmri string) string {
+	return sth.RunCmd(fmt.Sprintf("/bin/svcs%s -L %s", zoneFlag(zone), fmri))
+}
+
+var logTail = func(zone, path string, lines int) (string, error) {
+	out, err := exec.Command("/bin/pfexec", logTailArgs(zone, path, lines)...).Output()
+	return string(out), err
+}
+
+var now = time.Now
+
+// impactLine picks the number of affected services out of a line like
+// "Impact: 3 dependent services are not running:".
+var impactLine = regexp.MustCompile(`([0-9]+) dependent services? (is|are) not running`)
+
 func (s *IllumosSmf) Gather(acc telegraf.Accumulator) error {
-	data := parseSvcs(*s, rawOutput())
+	services, errs := svcList(rawOutput())
+
+	for _, err := range errs {
+		acc.AddError(err)
+	}
+
+	data := parseSvcs(*s, services)
 
 	for zone, stateCounts := range data.counts {
 		for state, count := range stateCounts {
@@ -72,12 +265,31 @@ func (s *IllumosSmf) Gather(acc telegraf.Accumulator) error {
 		}
 	}
 
+	explanations := make(map[string]map[string]svcExplanation)
+	dependencies := dependencyCache{}
+
 	for _, tags := range data.svcErrs {
+		fields := map[string]interface{}{
+			"errors": 1,
+		}
+
+		if s.Explain {
+			if _, explained := explanations[tags.zone]; !explained {
+				explanations[tags.zone] = parseSvcsExplain(svcsExplainOutput(tags.zone))
+			}
+
+			if explanation, ok := explanations[tags.zone][tags.fmri]; ok {
+				explanation.addFields(fields)
+			}
+		}
+
+		if s.Impact {
+			fields["impacted"] = dependencies.impacted(tags.zone, tags.fmri)
+		}
+
 		acc.AddFields(
 			"smf",
-			map[string]interface{}{
-				"errors": 1,
-			},
+			fields,
 			map[string]string{
 				"zone":  tags.zone,
 				"state": tags.state,
@@ -86,18 +298,924 @@ func (s *IllumosSmf) Gather(acc telegraf.Accumulator) error {
 		)
 	}
 
+	if len(s.Watch) > 0 {
+		s.gatherWatched(acc, services)
+	}
+
+	if s.TimeInState {
+		s.gatherTimeInState(acc, services)
+	}
+
+	if s.Transitions {
+		s.trackTransitions(acc, services)
+	}
+
+	if s.BootReadiness {
+		s.gatherBootReadiness(acc, services, dependencies)
+	}
+
+	if s.Restarts {
+		s.trackRestarts(acc, parseCtids(ctidOutput()))
+	}
+
+	if s.LogLines > 0 {
+		s.gatherLogs(acc, services)
+	}
+
+	if len(s.Properties) > 0 {
+		s.gatherProperties(acc, services)
+	}
+
+	if len(s.Desired) > 0 {
+		s.gatherDrift(acc, services)
+	}
+
 	return nil
 }
 
-func parseSvcs(s IllumosSmf, raw string) svcSummary {
+// gatherWatched sends a point for every service which matches one of the Watch patterns, with its
+// state as a number.
+func (s *IllumosSmf) gatherWatched(acc telegraf.Accumulator, svcs []svc) {
+	for _, service := range svcs {
+		if !sth.WeWant(service.zone, s.Zones) || !helpers.MatchesAny(service.fmri, s.Watch) {
+			continue
+		}
+
+		acc.AddFields(
+			"smf",
+			map[string]interface{}{
+				"service_state": statetoi(service.state),
+			},
+			map[string]string{
+				"zone":  service.zone,
+				"state": service.state,
+				"fmri":  service.fmri,
+			},
+		)
+	}
+}
+
+// statetoi converts the state of a service to an integer, so you can alert off it.
+// 0 : online
+// 1 : degraded
+// 2 : offline
+// 3 : maintenance
+// 4 : disabled
+// 5 : uninitialized
+// 99: <anything else>
+// A service in transition gets the number of the state it is leaving.
+func statetoi(state string) int {
+	states := []string{"online", "degraded", "offline", "maintenance", "disabled", "uninitialized"}
+
+	for i, s := range states {
+		if s == baseState(state) {
+			return i
+		}
+	}
+
+	return 99
+}
+
+// gatherBootReadiness sends a point for each zone, saying whether it has reached the
+// multi-user-server milestone. If it has not, we count the services it is waiting for. If it has,
+// we say how long after the zone booted it got there.
+func (s *IllumosSmf) gatherBootReadiness(
+	acc telegraf.Accumulator,
+	svcs []svc,
+	dependencies dependencyCache) {
+	states := make(map[svcKey]string)
+	seenZones := make(map[string]bool)
+	var zones []string
+
+	for _, service := range svcs {
+		if !sth.WeWant(service.zone, s.Zones) {
+			continue
+		}
+
+		if !seenZones[service.zone] {
+			seenZones[service.zone] = true
+			zones = append(zones, service.zone)
+		}
+
+		states[svcKey{service.zone, service.fmri}] = service.state
+	}
+
+	var bootTimes map[string]float64
+
+	for _, zone := range zones {
+		fields := map[string]interface{}{
+			"ready":   0,
+			"pending": 0,
+		}
+
+		if baseState(states[svcKey{zone, readyMilestone}]) == "online" {
+			fields["ready"] = 1
+
+			if bootTimes == nil {
+				bootTimes = zoneBootTimes()
+			}
+
+			readyTime, err := strconv.ParseFloat(strings.TrimSpace(milestoneTimeOutput(zone)), 64)
+			bootTime, booted := bootTimes[zone]
+
+			if err == nil && booted && readyTime >= bootTime {
+				fields["seconds_to_ready"] = readyTime - bootTime
+			}
+		} else {
+			fields["pending"] = dependencies.pending(zone, readyMilestone, states)
+		}
+
+		acc.AddFields(
+			"smf",
+			fields,
+			map[string]string{
+				"zone":      zone,
+				"milestone": "multi-user-server",
+			},
+		)
+	}
+}
+
+// pending counts the services the given one depends on, directly or otherwise, which are offline
+// or uninitialized, whether or not they are on their way to another state.
+func (c dependencyCache) pending(zone, fmri string, states map[svcKey]string) int {
+	pending := 0
+
+	for _, dependency := range walkGraph(c.graph(zone).dependencies, fmri) {
+		switch baseState(states[svcKey{zone, dependency}]) {
+		case "offline", "uninitialized":
+			pending++
+		}
+	}
+
+	return pending
+}
+
+// gatherTimeInState reports, for each service we are interested in, how many seconds it has been in
+// its current state. SMF records the time of every state change in the restarter/state_timestamp
+// property, which we read for a whole zone at a time.
+func (s *IllumosSmf) gatherTimeInState(acc telegraf.Accumulator, svcs []svc) {
+	timestamps := make(map[string]map[string]float64)
+	timeNow := float64(now().UnixNano()) / 1e9
+
+	for _, service := range svcs {
+		if !sth.WeWant(service.zone, s.Zones) || !sth.WeWant(service.state, s.SvcStates) {
+			continue
+		}
+
+		if _, ok := timestamps[service.zone]; !ok {
+			timestamps[service.zone] = parseStateTimestamps(stateTimestampOutput(service.zone))
+		}
+
+		changed, ok := timestamps[service.zone][service.fmri]
+
+		if !ok {
+			continue
+		}
+
+		acc.AddFields(
+			"smf",
+			map[string]interface{}{
+				"seconds_in_state": timeNow - changed,
+			},
+			map[string]string{
+				"zone":  service.zone,
+				"state": service.state,
+				"fmri":  service.fmri,
+			},
+		)
+	}
+}
+
+// parseStateTimestamps turns the output of 'svcprop -f -p restarter/state_timestamp' into a map of
+// FMRI to state change time. Lines look like
+// svc:/system/cron:default/:properties/restarter/state_timestamp time 1619280001.234567
+func parseStateTimestamps(raw string) map[string]float64 {
+	ret := make(map[string]float64)
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.Fields(line)
+
+		if len(chunks) != 3 || !strings.Contains(chunks[0], "/:properties/") {
+			continue
+		}
+
+		timestamp, err := strconv.ParseFloat(chunks[2], 64)
+
+		if err != nil {
+			continue
+		}
+
+		ret[strings.SplitN(chunks[0], "/:properties/", 2)[0]] = timestamp
+	}
+
+	return ret
+}
+
+// trackTransitions compares the state of each service with its state on the previous run, and
+// emits a point for every one which has changed. A service in transition is taken to be in the
+// state it is leaving, so a restart which is caught half-way is not counted. It also sends the number of times each service
+// has changed state inside the flap window. When a service stops flapping, its count is sent as
+// zero once, then dropped.
+func (s *IllumosSmf) trackTransitions(acc telegraf.Accumulator, svcs []svc) {
+	if s.lastStates == nil {
+		s.lastStates = make(map[svcKey]string)
+		s.changes = make(map[svcKey][]time.Time)
+	}
+
+	window := time.Duration(s.FlapWindow)
+
+	if window <= 0 {
+		window = defaultFlapWindow
+	}
+
+	currentStates := make(map[svcKey]string)
+	timeNow := now()
+
+	for _, service := range svcs {
+		if !sth.WeWant(service.zone, s.Zones) {
+			continue
+		}
+
+		key := svcKey{service.zone, service.fmri}
+		state := baseState(service.state)
+		currentStates[key] = state
+		lastState, seen := s.lastStates[key]
+
+		if !seen || lastState == state {
+			continue
+		}
+
+		s.changes[key] = append(s.changes[key], timeNow)
+
+		acc.AddFields(
+			"smf",
+			map[string]interface{}{
+				"transitions": 1,
+			},
+			map[string]string{
+				"zone":       service.zone,
+				"fmri":       service.fmri,
+				"from_state": lastState,
+				"to_state":   state,
+			},
+		)
+	}
+
+	for key, changeTimes := range s.changes {
+		recent := recentChanges(changeTimes, timeNow.Add(-window))
+
+		if len(recent) == 0 {
+			delete(s.changes, key)
+		} else {
+			s.changes[key] = recent
+		}
+
+		acc.AddFields(
+			"smf",
+			map[string]interface{}{
+				"flaps": len(recent),
+			},
+			map[string]string{
+				"zone": key.zone,
+				"fmri": key.fmri,
+			},
+		)
+	}
+
+	s.lastStates = currentStates
+}
+
+// gatherLogs sends the end of the log of every service which has gone into maintenance since we
+// last looked. Services already in maintenance when Telegraf starts are reported the first time
+// round. A service's log is sent once, however long it stays in maintenance, but if we can't send
+// it, we try again next time.
+func (s *IllumosSmf) gatherLogs(acc telegraf.Accumulator, svcs []svc) {
+	current := make(map[svcKey]bool)
+
+	for _, service := range svcs {
+		if baseState(service.state) != "maintenance" || !sth.WeWant(service.zone, s.Zones) {
+			continue
+		}
+
+		key := svcKey{service.zone, service.fmri}
+
+		if s.maintenance[key] {
+			current[key] = true
+			continue
+		}
+
+		logPath := strings.TrimSpace(logPathOutput(service.zone, service.fmri))
+
+		if !strings.HasPrefix(logPath, "/") {
+			acc.AddError(fmt.Errorf("cannot find log for %s in %s", service.fmri, service.zone))
+			continue
+		}
+
+		contents, err := logTail(service.zone, logPath, s.LogLines)
+
+		if err != nil {
+			acc.AddError(fmt.Errorf("cannot read log of %s in %s: %v", service.fmri, service.zone, err))
+			continue
+		}
+
+		acc.AddFields(
+			"smf_log",
+			map[string]interface{}{
+				"log": contents,
+			},
+			map[string]string{
+				"zone": service.zone,
+				"fmri": service.fmri,
+				"path": logPath,
+			},
+		)
+
+		current[key] = true
+	}
+
+	s.maintenance = current
+}
+
+// logTailArgs builds the command which reads the end of a service's log. svcs -L in the global
+// zone gives the path of a log in another zone as that zone sees it, and the zone's administrator
+// can set it to anything, so we must not open it in the global zone: a path with '..' in it, or a
+// symlink, could point at any file on the host. Instead we read it from inside the zone, with
+// zlogin(1). zlogin hands its arguments to a shell, so the path is quoted.
+func logTailArgs(zone, path string, lines int) []string {
+	tail := []string{"/bin/tail", fmt.Sprintf("-%d", lines)}
+
+	if inNgz() || zone == "global" {
+		return append(tail, path)
+	}
+
+	return append([]string{"/usr/sbin/zlogin", zone}, append(tail, shellQuote(path))...)
+}
+
+// shellQuote wraps a string in single quotes, so a shell takes it literally.
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+// gatherProperties sends a point for every property group we are asked about in every service
+// which matches. The point carries the values of the properties we want, and a hash of the whole
+// property group, so any change to it shows up.
+func (s *IllumosSmf) gatherProperties(acc telegraf.Accumulator, svcs []svc) {
+	for _, service := range svcs {
+		if !sth.WeWant(service.zone, s.Zones) {
+			continue
+		}
+
+		for pg, names := range s.propertyGroups(service.fmri) {
+			raw := propertyGroupOutput(service.zone, service.fmri, pg)
+			properties := parsePropertyGroup(raw)
+
+			if len(properties) == 0 {
+				continue
+			}
+
+			fields := map[string]interface{}{
+				"hash": hashPropertyGroup(raw),
+			}
+
+			tags := map[string]string{
+				"zone": service.zone,
+				"fmri": service.fmri,
+				"pg":   pg,
+			}
+
+			for _, name := range names {
+				property, ok := properties[name]
+
+				if !ok {
+					continue
+				}
+
+				if s.PropertyTags {
+					tags[name] = property.value
+				} else {
+					fields[name] = property.typedValue()
+				}
+			}
+
+			acc.AddFields("smf_properties", fields, tags)
+		}
+	}
+}
+
+// propertyGroups works out which properties we want from the given service, and arranges them by
+// property group.
+func (s *IllumosSmf) propertyGroups(fmri string) map[string][]string {
+	ret := make(map[string][]string)
+
+	for pattern, properties := range s.Properties {
+		if !helpers.MatchesAny(fmri, []string{pattern}) {
+			continue
+		}
+
+		for _, property := range properties {
+			chunks := strings.SplitN(property, "/", 2)
+
+			if len(chunks) != 2 {
+				continue
+			}
+
+			ret[chunks[0]] = append(ret[chunks[0]], chunks[1])
+		}
+	}
+
+	return ret
+}
+
+// parsePropertyGroup turns the output of 'svcprop -p <pg>' into a map of property name to value.
+// Lines look like
+// config/port count 8080
+func parsePropertyGroup(raw string) map[string]svcProperty {
+	ret := make(map[string]svcProperty)
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.SplitN(strings.TrimSpace(line), " ", 3)
+
+		if len(chunks) < 2 || !strings.Contains(chunks[0], "/") {
+			continue
+		}
+
+		property := svcProperty{kind: chunks[1]}
+
+		if len(chunks) == 3 {
+			property.value = chunks[2]
+		}
+
+		ret[strings.SplitN(chunks[0], "/", 2)[1]] = property
+	}
+
+	return ret
+}
+
+// typedValue turns numeric and boolean properties into numbers and booleans. Everything else,
+// including properties with more than one value, is left as a string.
+func (p svcProperty) typedValue() interface{} {
+	switch p.kind {
+	case "count", "integer":
+		if value, err := strconv.ParseInt(p.value, 10, 64); err == nil {
+			return value
+		}
+	case "boolean":
+		if value, err := strconv.ParseBool(p.value); err == nil {
+			return value
+		}
+	}
+
+	return p.value
+}
+
+func hashPropertyGroup(raw string) int64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.TrimSpace(raw)))
+
+	return int64(hash.Sum32())
+}
+
+// gatherDrift compares the enabled state of services with what the config says it should be. It
+// sends a count of drifted services for every zone covered by the config, and a point for each
+// drifted service. A service which should be enabled but is not there at all counts as drifted,
+// so long as it was named exactly, not with a glob.
+func (s *IllumosSmf) gatherDrift(acc telegraf.Accumulator, svcs []svc) {
+	byZone := make(map[string][]svc)
+
+	for _, service := range svcs {
+		if sth.WeWant(service.zone, s.Zones) {
+			byZone[service.zone] = append(byZone[service.zone], service)
+		}
+	}
+
+	for zone, zoneSvcs := range byZone {
+		desired := s.desiredServices(zone)
+
+		if len(desired) == 0 {
+			continue
+		}
+
+		drift := 0
+		present := make(map[string]bool)
+
+		for _, service := range zoneSvcs {
+			present[service.fmri] = true
+			wantEnabled, ok := desiredEnabled(service.fmri, desired)
+
+			if !ok || wantEnabled == isEnabled(service) {
+				continue
+			}
+
+			drift++
+			addDriftPoint(acc, service, wantEnabled)
+		}
+
+		for _, d := range desired {
+			if !d.enabled || present[d.pattern] || strings.ContainsAny(d.pattern, "*?") {
+				continue
+			}
+
+			drift++
+			addDriftPoint(acc, svc{zone: zone, state: "absent", fmri: d.pattern}, true)
+		}
+
+		acc.AddFields(
+			"smf",
+			map[string]interface{}{
+				"drift": drift,
+			},
+			map[string]string{
+				"zone": zone,
+			},
+		)
+	}
+}
+
+// desiredServices collects, in order, the services which should be enabled or disabled in the
+// given zone.
+func (s *IllumosSmf) desiredServices(zone string) []desiredService {
+	var ret []desiredService
+
+	for _, d := range s.Desired {
+		if len(d.Zones) > 0 && !helpers.MatchesAny(zone, d.Zones) {
+			continue
+		}
+
+		for _, pattern := range d.Enabled {
+			ret = append(ret, desiredService{pattern, true})
+		}
+
+		for _, pattern := range d.Disabled {
+			ret = append(ret, desiredService{pattern, false})
+		}
+	}
+
+	return ret
+}
+
+// desiredEnabled says whether the given service should be enabled. The second value is false if
+// we have no opinion. If more than one pattern matches, the last one wins.
+func desiredEnabled(fmri string, desired []desiredService) (bool, bool) {
+	var enabled, found bool
+
+	for _, d := range desired {
+		if helpers.MatchesAny(fmri, []string{d.pattern}) {
+			enabled, found = d.enabled, true
+		}
+	}
+
+	return enabled, found
+}
+
+// isEnabled says whether a service is enabled. The state tells us, except for services which the
+// restarter has not yet looked at. For those we ask SMF what it has been told.
+func isEnabled(service svc) bool {
+	if service.state == "uninitialized" {
+		return strings.TrimSpace(enabledPropertyOutput(service.zone, service.fmri)) == "true"
+	}
+
+	return service.state != "disabled"
+}
+
+func addDriftPoint(acc telegraf.Accumulator, service svc, wantEnabled bool) {
+	desired := "disabled"
+
+	if wantEnabled {
+		desired = "enabled"
+	}
+
+	acc.AddFields(
+		"smf",
+		map[string]interface{}{
+			"drifted": 1,
+		},
+		map[string]string{
+			"zone":    service.zone,
+			"fmri":    service.fmri,
+			"state":   service.state,
+			"desired": desired,
+		},
+	)
+}
+
+// parseSvcsExplain turns the output of 'svcs -xv' into a map of explanations, keyed by FMRI. Each
+// service's block starts with its FMRI, and we pick out the Reason:, See: and Impact: lines. A
+// See: line can point to a manual page, a log file, or a web page, which we ignore.
+func parseSvcsExplain(raw string) map[string]svcExplanation {
+	ret := make(map[string]svcExplanation)
+	var fmri string
+
+	for _, line := range strings.Split(raw, "\n") {
+		if strings.HasPrefix(line, "svc:/") || strings.HasPrefix(line, "lrc:/") {
+			fmri = strings.Fields(line)[0]
+			ret[fmri] = svcExplanation{}
+			continue
+		}
+
+		if fmri == "" {
+			continue
+		}
+
+		explanation := ret[fmri]
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "Reason:"):
+			explanation.reason = strings.TrimSpace(strings.TrimPrefix(line, "Reason:"))
+		case strings.HasPrefix(line, "See:"):
+			ref := strings.TrimSpace(strings.TrimPrefix(line, "See:"))
+
+			if strings.HasPrefix(ref, "man ") {
+				explanation.manpage = ref
+			} else if strings.HasPrefix(ref, "/") {
+				explanation.log = ref
+			}
+		case strings.HasPrefix(line, "Impact:"):
+			if match := impactLine.FindStringSubmatch(line); match != nil {
+				explanation.dependents, _ = strconv.Atoi(match[1])
+			}
+		}
+
+		ret[fmri] = explanation
+	}
+
+	return ret
+}
+
+// impacted counts the services which depend on the given one, directly or through other services.
+// Each is counted once, however many routes there are to it.
+func (c dependencyCache) impacted(zone, fmri string) int {
+	return len(walkGraph(c.graph(zone).dependents, fmri))
+}
+
+// graph gets the dependency graph of a zone, building it from a single 'svcs -l' the first time
+// it is asked for.
+func (c dependencyCache) graph(zone string) svcGraph {
+	if graph, ok := c[zone]; ok {
+		return graph
+	}
+
+	graph := parseSvcsLong(svcsLongOutput(zone))
+	c[zone] = graph
+
+	return graph
+}
+
+// walkGraph returns every node which can be reached from the given one, not counting itself.
+func walkGraph(edges map[string][]string, start string) []string {
+	seen := map[string]bool{start: true}
+	queue := []string{start}
+	var ret []string
+
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		for _, node := range edges[next] {
+			if !seen[node] {
+				seen[node] = true
+				ret = append(ret, node)
+				queue = append(queue, node)
+			}
+		}
+	}
+
+	return ret
+}
+
+// parseSvcsLong builds a dependency graph from the output of 'svcs -l' for every instance in a
+// zone. Each instance is a block of lines, starting with its fmri, and with a line like
+// "dependency   require_all/none svc:/system/filesystem/local (online)" for each dependency
+// group. A group can name several FMRIs, followed by their states in brackets. A dependency on a
+// service, rather than an instance, is a dependency on all its instances. Dependencies on files
+// are not services, and are ignored.
+func parseSvcsLong(raw string) svcGraph {
+	var fmris []string
+	named := make(map[string][]string)
+	var fmri string
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.Fields(line)
+
+		if len(chunks) < 2 {
+			continue
+		}
+
+		switch chunks[0] {
+		case "fmri":
+			fmri = chunks[1]
+			fmris = append(fmris, fmri)
+		case "dependency":
+			if fmri == "" {
+				continue
+			}
+
+			for _, dependency := range chunks[2:] {
+				if strings.HasPrefix(dependency, "(") {
+					break
+				}
+
+				if strings.HasPrefix(dependency, "svc:/") {
+					named[fmri] = append(named[fmri], dependency)
+				}
+			}
+		}
+	}
+
+	graph := svcGraph{
+		dependencies: make(map[string][]string),
+		dependents:   make(map[string][]string),
+	}
+
+	for _, fmri := range fmris {
+		for _, dependency := range named[fmri] {
+			for _, instance := range instancesOf(dependency, fmris) {
+				graph.dependencies[fmri] = append(graph.dependencies[fmri], instance)
+				graph.dependents[instance] = append(graph.dependents[instance], fmri)
+			}
+		}
+	}
+
+	return graph
+}
+
+// instancesOf turns a dependency into the instances it refers to. An instance FMRI has a colon
+// after the "svc:" one.
+func instancesOf(dependency string, fmris []string) []string {
+	if strings.Contains(strings.TrimPrefix(dependency, "svc:/"), ":") {
+		return []string{dependency}
+	}
+
+	var ret []string
+
+	for _, fmri := range fmris {
+		if strings.HasPrefix(fmri, dependency+":") {
+			ret = append(ret, fmri)
+		}
+	}
+
+	return ret
+}
+
+// addFields puts whatever we know about a service's problem into a set of fields.
+func (e svcExplanation) addFields(fields map[string]interface{}) {
+	if e.reason != "" {
+		fields["reason"] = e.reason
+	}
+
+	if e.log != "" {
+		fields["log"] = e.log
+	}
+
+	if e.manpage != "" {
+		fields["manpage"] = e.manpage
+	}
+
+	fields["dependents"] = e.dependents
+}
+
+// trackRestarts compares the contract ID of each service with the one it had last time. When
+// svc.startd restarts a service, it gets a new contract, so a change from one contract to another
+// is a restart. Services without a contract have a ctid of "-", and going to or from that is a
+// stop or a start, not a restart. We send a cumulative count for each service which has restarted
+// since Telegraf started.
+func (s *IllumosSmf) trackRestarts(acc telegraf.Accumulator, ctids map[svcKey]string) {
+	if s.ctids == nil {
+		s.ctids = make(map[svcKey]string)
+		s.restarts = make(map[svcKey]svcRestarts)
+	}
+
+	timeNow := now()
+
+	for key, ctid := range ctids {
+		if !sth.WeWant(key.zone, s.Zones) {
+			continue
+		}
+
+		lastCtid, seen := s.ctids[key]
+
+		if seen && lastCtid != ctid && lastCtid != "-" && ctid != "-" {
+			s.restarts[key] = svcRestarts{count: s.restarts[key].count + 1, last: timeNow}
+		}
+	}
+
+	s.ctids = ctids
+
+	for key, restarts := range s.restarts {
+		fields := map[string]interface{}{
+			"restarts": restarts.count,
+		}
+
+		if s.RestartTime {
+			fields["last_restart"] = restarts.last.Unix()
+		}
+
+		acc.AddFields(
+			"smf",
+			fields,
+			map[string]string{
+				"zone": key.zone,
+				"fmri": key.fmri,
+			},
+		)
+	}
+}
+
+// parseCtids turns the output of 'svcs -ozone,ctid,fmri' into a map of service to contract ID. In
+// an NGZ there is no zone column.
+func parseCtids(raw string) map[svcKey]string {
+	ret := make(map[svcKey]string)
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.Fields(line)
+
+		if inNgz() && len(chunks) > 0 {
+			chunks = append([]string{zoneName}, chunks...)
+		}
+
+		if len(chunks) != 3 {
+			continue
+		}
+
+		ret[svcKey{zone: chunks[0], fmri: chunks[2]}] = chunks[1]
+	}
+
+	return ret
+}
+
+// recentChanges returns those changeTimes which are after the cutoff.
+func recentChanges(changeTimes []time.Time, cutoff time.Time) []time.Time {
+	var ret []time.Time
+
+	for _, t := range changeTimes {
+		if t.After(cutoff) {
+			ret = append(ret, t)
+		}
+	}
+
+	return ret
+}
+
+// inNgz is true when Telegraf is running in a non-global zone. There, svcs(1) can only see the
+// local zone, and does not understand -z or -Z.
+func inNgz() bool {
+	return zoneName != "" && zoneName != "global"
+}
+
+// baseState strips the '*' which svcs(1) puts on the state of a service which is in transition,
+// so "online*" is "online".
+func baseState(state string) string {
+	return strings.TrimSuffix(state, "*")
+}
+
+// zoneFlag gives the option which points a command at the given zone, or nothing if we are in an
+// NGZ, where the only zone we can see is our own.
+func zoneFlag(zone string) string {
+	if inNgz() {
+		return ""
+	}
+
+	return " -z " + zone
+}
+
+// svcList turns the raw output of svcs(1) into a list of services. In the global zone each line is
+// zone, state and FMRI; in an NGZ there is no zone column, so we use the local zone name. Blank
+// lines are skipped, and any others we cannot understand are returned as errors.
+func svcList(raw string) ([]svc, []error) {
+	var ret []svc
+	var errs []error
+
+	for _, svcLine := range strings.Split(raw, "\n") {
+		chunks := strings.Fields(svcLine)
+
+		if len(chunks) == 0 {
+			continue
+		}
+
+		if inNgz() {
+			chunks = append([]string{zoneName}, chunks...)
+		}
+
+		if len(chunks) != 3 {
+			errs = append(errs, fmt.Errorf("cannot parse svcs output: %q", svcLine))
+			continue
+		}
+
+		ret = append(ret, svc{zone: chunks[0], state: chunks[1], fmri: chunks[2]})
+	}
+
+	return ret, errs
+}
+
+func parseSvcs(s IllumosSmf, svcs []svc) svcSummary {
 	ret := svcSummary{
 		counts:  svcCounts{},
 		svcErrs: svcErrs{},
 	}
 
-	for _, svcLine := range strings.Split(raw, "\n") {
-		chunks := strings.Fields(svcLine)
-		zone, state, fmri := chunks[0], chunks[1], chunks[2]
+	for _, service := range svcs {
+		zone, state, fmri := service.zone, service.state, service.fmri
 
 		if !sth.WeWant(zone, s.Zones) || !sth.WeWant(state, s.SvcStates) {
 			continue
@@ -126,5 +1244,6 @@ func parseSvcs(s IllumosSmf, raw string) svcSummary {
 }
 
 func init() {
+	zoneName = sth.ZoneName()
 	inputs.Add("illumos_smf", func() telegraf.Input { return &IllumosSmf{} })
 }
@@ -1,10 +1,13 @@
 package illumos_smf
 
 import (
+	"errors"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
 	"github.com/influxdata/telegraf/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 	"time"
 )
@@ -104,7 +107,7 @@ func TestParseSvcsNoFilters(t *testing.T) {
 			},
 			svcErrs: svcErrs{},
 		},
-		parseSvcs(testConfig, sampleOutput))
+		parseSvcs(testConfig, sampleSvcs(t)))
 }
 
 func TestParseSvcsFilters(t *testing.T) {
@@ -135,9 +138,904 @@ func TestParseSvcsFilters(t *testing.T) {
 				},
 			},
 		},
-		parseSvcs(testConfig, sampleOutput))
+		parseSvcs(testConfig, sampleSvcs(t)))
 }
 
+func TestSvcListMalformed(t *testing.T) {
+	svcs, errs := svcList("global  online  svc:/system/cron:default\nglobal  online\n\n")
+
+	assert.Equal(t, []svc{{zone: "global", state: "online", fmri: "svc:/system/cron:default"}}, svcs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, `cannot parse svcs output: "global  online"`, errs[0].Error())
+}
+
+func TestPluginMalformed(t *testing.T) {
+	s := &IllumosSmf{}
+
+	rawOutput = func() string {
+		return "global  online  svc:/system/cron:default\nrubbish\n"
+	}
+
+	acc := testutil.Accumulator{}
+	require.NoError(t, s.Gather(&acc))
+	assert.Len(t, acc.Errors, 1)
+	assert.Len(t, acc.GetTelegrafMetrics(), 1)
+}
+
+func TestSvcListNgz(t *testing.T) {
+	zoneName = "cube-cron"
+	defer func() { zoneName = "" }()
+
+	svcs, errs := svcList(ngzSample)
+
+	assert.Empty(t, errs)
+	assert.Equal(
+		t,
+		[]svc{
+			{zone: "cube-cron", state: "online", fmri: "svc:/system/cron:default"},
+			{zone: "cube-cron", state: "maintenance", fmri: "svc:/sysdef/puppet:default"},
+			{zone: "cube-cron", state: "legacy_run", fmri: "lrc:/etc/rc2_d/S89PRESERVE"},
+		},
+		svcs)
+
+	assert.Equal(
+		t,
+		map[svcKey]string{{zone: "cube-cron", fmri: "svc:/system/cron:default"}: "93"},
+		parseCtids("93  svc:/system/cron:default"))
+
+	assert.Equal(t, "", zoneFlag("cube-cron"))
+}
+
+func TestPluginExplain(t *testing.T) {
+	s := &IllumosSmf{
+		SvcStates:       []string{"maintenance"},
+		GenerateDetails: true,
+		Explain:         true,
+	}
+
+	rawOutput = func() string {
+		return sampleOutput
+	}
+
+	explained := []string{}
+
+	svcsExplainOutput = func(zone string) string {
+		explained = append(explained, zone)
+		return svcsExplainSample
+	}
+
+	acc := testutil.Accumulator{}
+	require.NoError(t, s.Gather(&acc))
+
+	assert.Equal(t, []string{"cube-pkgsrc"}, explained)
+
+	assert.True(t, acc.HasPoint(
+		"smf",
+		map[string]string{
+			"zone":  "cube-pkgsrc",
+			"state": "maintenance",
+			"fmri":  "svc:/system/filesystem/local:default",
+		},
+		"reason",
+		"Start method exited with $SMF_EXIT_ERR_FATAL."))
+
+	assert.True(t, acc.HasPoint(
+		"smf",
+		map[string]string{
+			"zone":  "cube-pkgsrc",
+			"state": "maintenance",
+			"fmri":  "svc:/system/filesystem/local:default",
+		},
+		"dependents",
+		3))
+}
+
+func TestParseSvcsExplain(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]svcExplanation{
+			"svc:/system/filesystem/local:default": {
+				reason:     "Start method exited with $SMF_EXIT_ERR_FATAL.",
+				log:        "/var/svc/log/system-filesystem-local:default.log",
+				manpage:    "man -M /usr/share/man -s 1M mountall",
+				dependents: 3,
+			},
+			"svc:/network/rpc/gss:default": {
+				reason:     "Restarter svc:/network/inetd:default is not running.",
+				manpage:    "man -M /usr/share/man -s 1M gssd",
+				dependents: 1,
+			},
+			"svc:/application/pkgsrc/nginx:default": {
+				reason: "Start method failed repeatedly, last exited with status 1.",
+				log:    "/var/svc/log/application-pkgsrc-nginx:default.log",
+			},
+		},
+		parseSvcsExplain(svcsExplainSample))
+
+	assert.Equal(t, map[string]svcExplanation{}, parseSvcsExplain(""))
+}
+
+func TestGatherTimeInState(t *testing.T) {
+	s := &IllumosSmf{
+		SvcStates: []string{"maintenance", "online"},
+		Zones:     []string{"cube-pkgsrc", "cube-cron"},
+	}
+
+	now = func() time.Time { return time.Unix(1619280601, 500000000) }
+	zones := []string{}
+
+	stateTimestampOutput = func(zone string) string {
+		zones = append(zones, zone)
+
+		if zone == "cube-pkgsrc" {
+			return stateTimestampSample
+		}
+
+		return ""
+	}
+
+	acc := testutil.Accumulator{}
+	s.gatherTimeInState(&acc, sampleSvcs(t))
+
+	assert.Equal(t, []string{"cube-pkgsrc", "cube-cron"}, zones)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			timeInStateMetric("maintenance", "svc:/system/filesystem/local:default", 600.25),
+			timeInStateMetric("online", "svc:/system/filesystem/minimal:default", 86400.5),
+			timeInStateMetric("online", "svc:/system/manifest-import:default", 90000),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestParseStateTimestamps(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]float64{
+			"svc:/system/filesystem/local:default":   1619280001.25,
+			"svc:/system/filesystem/minimal:default": 1619194201,
+			"svc:/system/manifest-import:default":    1619190601.5,
+		},
+		parseStateTimestamps(stateTimestampSample))
+}
+
+func TestGatherWatched(t *testing.T) {
+	s := &IllumosSmf{
+		Zones: []string{"cube-pkgsrc", "global"},
+		Watch: []string{"svc:/system/filesystem/*", "svc:/network/varpd:default"},
+	}
+
+	acc := testutil.Accumulator{}
+	s.gatherWatched(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			watchedMetric("cube-pkgsrc", "maintenance", "svc:/system/filesystem/local:default", 3),
+			watchedMetric("cube-pkgsrc", "online", "svc:/system/filesystem/minimal:default", 0),
+			watchedMetric("global", "disabled", "svc:/network/varpd:default", 4),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestStatetoi(t *testing.T) {
+	assert.Equal(t, 0, statetoi("online"))
+	assert.Equal(t, 3, statetoi("maintenance"))
+	assert.Equal(t, 5, statetoi("uninitialized"))
+	assert.Equal(t, 99, statetoi("legacy_run"))
+	assert.Equal(t, 0, statetoi("online*"))
+	assert.Equal(t, 2, statetoi("offline*"))
+	assert.Equal(t, 3, statetoi("maintenance*"))
+	assert.Equal(t, 99, statetoi("legacy_run*"))
+}
+
+func watchedMetric(zone, state, fmri string, value int) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone":  zone,
+			"state": state,
+			"fmri":  fmri,
+		},
+		map[string]interface{}{
+			"service_state": value,
+		},
+		time.Now(),
+	)
+}
+
+func timeInStateMetric(state, fmri string, seconds float64) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone":  "cube-pkgsrc",
+			"state": state,
+			"fmri":  fmri,
+		},
+		map[string]interface{}{
+			"seconds_in_state": seconds,
+		},
+		time.Now(),
+	)
+}
+
+func TestTrackTransitions(t *testing.T) {
+	s := &IllumosSmf{
+		Zones:      []string{"cube-pkgsrc", "cube-cron"},
+		FlapWindow: config.Duration(10 * time.Minute),
+	}
+
+	start := time.Date(2021, 4, 24, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	acc := testutil.Accumulator{}
+	s.trackTransitions(&acc, sampleSvcs(t))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+
+	changed := strings.Replace(sampleOutput,
+		"cube-pkgsrc      maintenance    svc:/system/filesystem/local:default",
+		"cube-pkgsrc      online         svc:/system/filesystem/local:default", 1)
+	changed = strings.Replace(changed,
+		"cube-cron        online         svc:/sysdef/puppet:default",
+		"cube-cron        maintenance    svc:/sysdef/puppet:default", 1)
+	changed = strings.Replace(changed,
+		"global           online         svc:/sdef/diamond:default",
+		"global           maintenance    svc:/sdef/diamond:default", 1)
+
+	svcs, errs := svcList(changed)
+	require.Empty(t, errs)
+
+	now = func() time.Time { return start.Add(time.Minute) }
+	s.trackTransitions(&acc, svcs)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			transitionMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", "maintenance",
+				"online"),
+			transitionMetric("cube-cron", "svc:/sysdef/puppet:default", "online", "maintenance"),
+			flapMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", 1),
+			flapMetric("cube-cron", "svc:/sysdef/puppet:default", 1),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+
+	// puppet goes back to online: a second flap
+	acc.ClearMetrics()
+	now = func() time.Time { return start.Add(5 * time.Minute) }
+	s.trackTransitions(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			transitionMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", "online",
+				"maintenance"),
+			transitionMetric("cube-cron", "svc:/sysdef/puppet:default", "maintenance", "online"),
+			flapMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", 2),
+			flapMetric("cube-cron", "svc:/sysdef/puppet:default", 2),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+
+	// nothing changes, and the first flaps fall out of the window
+	acc.ClearMetrics()
+	now = func() time.Time { return start.Add(12 * time.Minute) }
+	s.trackTransitions(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			flapMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", 1),
+			flapMetric("cube-cron", "svc:/sysdef/puppet:default", 1),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+
+	// all the flaps are outside the window: they are reported as zero once, then forgotten
+	acc.ClearMetrics()
+	now = func() time.Time { return start.Add(20 * time.Minute) }
+	s.trackTransitions(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			flapMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", 0),
+			flapMetric("cube-cron", "svc:/sysdef/puppet:default", 0),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+
+	acc.ClearMetrics()
+	s.trackTransitions(&acc, sampleSvcs(t))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+
+	// puppet is seen part-way through a restart, then online again: that is not a transition
+	restarting := strings.Replace(sampleOutput,
+		"cube-cron        online         svc:/sysdef/puppet:default",
+		"cube-cron        online*        svc:/sysdef/puppet:default", 1)
+
+	svcs, errs = svcList(restarting)
+	require.Empty(t, errs)
+
+	s.trackTransitions(&acc, svcs)
+	s.trackTransitions(&acc, sampleSvcs(t))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestTrackRestarts(t *testing.T) {
+	s := &IllumosSmf{
+		Zones:       []string{"cube-cron"},
+		RestartTime: true,
+	}
+
+	start := time.Unix(1619280000, 0)
+	now = func() time.Time { return start }
+
+	acc := testutil.Accumulator{}
+	s.trackRestarts(&acc, parseCtids(ctidSample))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+
+	// cron gets a new contract (a restart), puppet is stopped, audio is started, and the zone
+	// we are not interested in restarts everything
+	later := `cube-cron        93   svc:/system/cron:default
+cube-cron        -    svc:/sysdef/puppet:default
+cube-cron        95   svc:/system/device/audio:default
+global           99   svc:/system/cron:default`
+
+	now = func() time.Time { return start.Add(time.Minute) }
+	s.trackRestarts(&acc, parseCtids(later))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{restartMetric("svc:/system/cron:default", 1, 1619280060)},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+
+	// the counter is cumulative, and is sent even when nothing changes
+	acc.ClearMetrics()
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	s.trackRestarts(&acc, parseCtids(strings.Replace(later, " 93 ", " 102 ", 1)))
+	s.trackRestarts(&acc, parseCtids(strings.Replace(later, " 93 ", " 102 ", 1)))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			restartMetric("svc:/system/cron:default", 2, 1619280120),
+			restartMetric("svc:/system/cron:default", 2, 1619280120),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestParseCtids(t *testing.T) {
+	assert.Equal(
+		t,
+		map[svcKey]string{
+			{zone: "cube-cron", fmri: "svc:/system/cron:default"}:         "64",
+			{zone: "cube-cron", fmri: "svc:/sysdef/puppet:default"}:       "71",
+			{zone: "cube-cron", fmri: "svc:/system/device/audio:default"}: "-",
+			{zone: "global", fmri: "svc:/system/cron:default"}:            "12",
+		},
+		parseCtids(ctidSample))
+}
+
+func restartMetric(fmri string, count int, last int64) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone": "cube-cron",
+			"fmri": fmri,
+		},
+		map[string]interface{}{
+			"restarts":     count,
+			"last_restart": last,
+		},
+		time.Now(),
+	)
+}
+
+func transitionMetric(zone, fmri, from, to string) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone":       zone,
+			"fmri":       fmri,
+			"from_state": from,
+			"to_state":   to,
+		},
+		map[string]interface{}{
+			"transitions": 1,
+		},
+		time.Now(),
+	)
+}
+
+func flapMetric(zone, fmri string, flaps int) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone": zone,
+			"fmri": fmri,
+		},
+		map[string]interface{}{
+			"flaps": flaps,
+		},
+		time.Now(),
+	)
+}
+
+func TestImpacted(t *testing.T) {
+	calls := 0
+
+	svcsLongOutput = func(zone string) string {
+		assert.Equal(t, "cube-dns", zone)
+		calls++
+		return svcsLongSample
+	}
+
+	deps := dependencyCache{}
+	assert.Equal(t, 5, deps.impacted("cube-dns", "svc:/network/physical:default"))
+	assert.Equal(t, 5, deps.impacted("cube-dns", "svc:/network/physical:nwam"))
+	assert.Equal(t, 7, deps.impacted("cube-dns", "svc:/network/loopback:default"))
+	assert.Equal(t, 4, deps.impacted("cube-dns", "svc:/milestone/network:default"))
+	assert.Equal(t, 0, deps.impacted("cube-dns", "svc:/network/ntp:default"))
+	assert.Equal(t, 0, deps.impacted("cube-dns", "svc:/no/such/service:default"))
+	assert.Equal(t, 1, calls)
+}
+
+func TestParseSvcsLong(t *testing.T) {
+	graph := parseSvcsLong(svcsLongSample)
+
+	assert.ElementsMatch(
+		t,
+		[]string{
+			"svc:/network/loopback:default",
+			"svc:/network/physical:default",
+			"svc:/network/physical:nwam",
+		},
+		graph.dependencies["svc:/milestone/network:default"])
+
+	assert.ElementsMatch(
+		t,
+		[]string{"svc:/milestone/network:default", "svc:/network/physical:default"},
+		graph.dependencies["svc:/network/ssh:default"])
+
+	assert.ElementsMatch(
+		t,
+		[]string{"svc:/milestone/network:default", "svc:/network/ssh:default"},
+		graph.dependents["svc:/network/physical:default"])
+
+	assert.Empty(t, graph.dependencies["svc:/network/loopback:default"])
+	assert.Empty(t, parseSvcsLong("").dependencies)
+}
+
+func TestGatherProperties(t *testing.T) {
+	s := &IllumosSmf{
+		Zones: []string{"cube-pkgsrc", "cube-cron"},
+		Properties: map[string][]string{
+			"svc:/system/filesystem/*":   {"config/port", "start/timeout_seconds"},
+			"svc:/sysdef/puppet:default": {"general/enabled", "start/exec"},
+		},
+	}
+
+	asked := []string{}
+
+	propertyGroupOutput = func(zone, fmri, pg string) string {
+		asked = append(asked, zone+" "+fmri+" "+pg)
+
+		switch pg {
+		case "start":
+			return startPgSample
+		case "general":
+			return "general/enabled boolean true\ngeneral/entity_stability astring Unstable"
+		default:
+			return ""
+		}
+	}
+
+	acc := testutil.Accumulator{}
+	s.gatherProperties(&acc, sampleSvcs(t))
+
+	assert.ElementsMatch(
+		t,
+		[]string{
+			"cube-pkgsrc svc:/system/filesystem/local:default config",
+			"cube-pkgsrc svc:/system/filesystem/local:default start",
+			"cube-pkgsrc svc:/system/filesystem/minimal:default config",
+			"cube-pkgsrc svc:/system/filesystem/minimal:default start",
+			"cube-cron svc:/sysdef/puppet:default general",
+			"cube-cron svc:/sysdef/puppet:default start",
+		},
+		asked)
+
+	startHash := hashPropertyGroup(startPgSample)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			propertyMetric("cube-cron", "svc:/sysdef/puppet:default", "general",
+				map[string]interface{}{
+					"enabled": true,
+					"hash": hashPropertyGroup("general/enabled boolean true\n" +
+						"general/entity_stability astring Unstable"),
+				}),
+			propertyMetric("cube-cron", "svc:/sysdef/puppet:default", "start",
+				map[string]interface{}{
+					"exec": `/opt/puppet/bin/puppet agent --no-daemonize`,
+					"hash": startHash,
+				}),
+			propertyMetric("cube-pkgsrc", "svc:/system/filesystem/local:default", "start",
+				map[string]interface{}{"timeout_seconds": int64(300), "hash": startHash}),
+			propertyMetric("cube-pkgsrc", "svc:/system/filesystem/minimal:default", "start",
+				map[string]interface{}{"timeout_seconds": int64(300), "hash": startHash}),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestGatherPropertiesAsTags(t *testing.T) {
+	s := &IllumosSmf{
+		Zones:        []string{"cube-cron"},
+		Properties:   map[string][]string{"svc:/sysdef/puppet:default": {"start/timeout_seconds"}},
+		PropertyTags: true,
+	}
+
+	propertyGroupOutput = func(zone, fmri, pg string) string {
+		return startPgSample
+	}
+
+	acc := testutil.Accumulator{}
+	s.gatherProperties(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"smf_properties",
+				map[string]string{
+					"zone":            "cube-cron",
+					"fmri":            "svc:/sysdef/puppet:default",
+					"pg":              "start",
+					"timeout_seconds": "300",
+				},
+				map[string]interface{}{
+					"hash": hashPropertyGroup(startPgSample),
+				},
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestParsePropertyGroup(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]svcProperty{
+			"exec":            {kind: "astring", value: "/opt/puppet/bin/puppet agent --no-daemonize"},
+			"timeout_seconds": {kind: "count", value: "300"},
+			"type":            {kind: "astring", value: "method"},
+			"project":         {kind: "astring", value: ""},
+		},
+		parsePropertyGroup(startPgSample+"\nstart/project astring"))
+}
+
+func TestTypedValue(t *testing.T) {
+	assert.Equal(t, int64(300), svcProperty{kind: "count", value: "300"}.typedValue())
+	assert.Equal(t, int64(-1), svcProperty{kind: "integer", value: "-1"}.typedValue())
+	assert.Equal(t, false, svcProperty{kind: "boolean", value: "false"}.typedValue())
+	assert.Equal(t, "1 2", svcProperty{kind: "count", value: "1 2"}.typedValue())
+	assert.Equal(t, "method", svcProperty{kind: "astring", value: "method"}.typedValue())
+}
+
+func propertyMetric(zone, fmri, pg string, fields map[string]interface{}) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf_properties",
+		map[string]string{
+			"zone": zone,
+			"fmri": fmri,
+			"pg":   pg,
+		},
+		fields,
+		time.Now(),
+	)
+}
+
+func TestGatherDrift(t *testing.T) {
+	s := &IllumosSmf{
+		Zones: []string{"cube-pkgsrc", "cube-cron", "global"},
+		Desired: []desiredState{
+			{
+				Zones:    []string{"cube-*"},
+				Enabled:  []string{"svc:/system/*", "svc:/network/ssh:default"},
+				Disabled: []string{"svc:/system/svc/global:default", "svc:/sysdef/puppet:default"},
+			},
+			{
+				Zones:   []string{"cube-cron"},
+				Enabled: []string{"svc:/system/device/allocate:default"},
+			},
+		},
+	}
+
+	enabledPropertyOutput = func(zone, fmri string) string {
+		t.Errorf("no service is uninitialized")
+		return ""
+	}
+
+	acc := testutil.Accumulator{}
+	s.gatherDrift(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			driftMetric("cube-cron", 4),
+			driftMetric("cube-pkgsrc", 1),
+			driftedMetric("cube-cron", "svc:/network/ssh:default", "absent", "enabled"),
+			driftedMetric("cube-cron", "svc:/sysdef/puppet:default", "online", "disabled"),
+			driftedMetric("cube-cron", "svc:/system/device/mpxio-upgrade:default", "disabled",
+				"enabled"),
+			driftedMetric("cube-cron", "svc:/system/device/allocate:default", "disabled", "enabled"),
+			driftedMetric("cube-pkgsrc", "svc:/network/ssh:default", "absent", "enabled"),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestIsEnabled(t *testing.T) {
+	enabledPropertyOutput = func(zone, fmri string) string {
+		if fmri == "svc:/network/rpc/gss:default" {
+			return "true"
+		}
+
+		return "false"
+	}
+
+	assert.True(t, isEnabled(svc{"global", "maintenance", "svc:/network/ntp:default"}))
+	assert.False(t, isEnabled(svc{"global", "disabled", "svc:/network/ntp:default"}))
+	assert.True(t, isEnabled(svc{"global", "uninitialized", "svc:/network/rpc/gss:default"}))
+	assert.False(t, isEnabled(svc{"global", "uninitialized", "svc:/network/rquota:default"}))
+}
+
+func driftMetric(zone string, drift int) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone": zone,
+		},
+		map[string]interface{}{
+			"drift": drift,
+		},
+		time.Now(),
+	)
+}
+
+func driftedMetric(zone, fmri, state, desired string) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone":    zone,
+			"fmri":    fmri,
+			"state":   state,
+			"desired": desired,
+		},
+		map[string]interface{}{
+			"drifted": 1,
+		},
+		time.Now(),
+	)
+}
+
+func TestGatherBootReadiness(t *testing.T) {
+	s := &IllumosSmf{Zones: []string{"cube-pkgsrc", "cube-cron", "global"}}
+
+	raw := sampleOutput + `
+cube-pkgsrc      offline        svc:/milestone/multi-user-server:default
+cube-pkgsrc      offline        svc:/milestone/multi-user:default
+cube-pkgsrc      uninitialized  svc:/network/rpc/bind:default
+cube-pkgsrc      offline*       svc:/network/ssh:default
+cube-cron        online*        svc:/milestone/multi-user-server:default
+global           online         svc:/milestone/multi-user-server:default`
+
+	svcs, errs := svcList(raw)
+	require.Empty(t, errs)
+
+	calls := 0
+
+	svcsLongOutput = func(zone string) string {
+		assert.Equal(t, "cube-pkgsrc", zone)
+		calls++
+
+		return `fmri         svc:/milestone/multi-user-server:default
+dependency   require_all/none svc:/milestone/multi-user (offline)
+dependency   require_all/none svc:/system/manifest-import (online)
+
+fmri         svc:/milestone/multi-user:default
+dependency   require_all/none svc:/system/filesystem/local (maintenance)
+dependency   require_all/none svc:/network/rpc/bind (uninitialized)
+dependency   optional_all/none svc:/network/ssh:default (offline)
+dependency   require_all/none svc:/system/manifest-import (online)
+
+fmri         svc:/system/manifest-import:default
+fmri         svc:/system/filesystem/local:default
+fmri         svc:/network/rpc/bind:default
+fmri         svc:/network/ssh:default
+`
+	}
+
+	milestoneTimeOutput = func(zone string) string {
+		if zone == "global" {
+			return "1619280100.5"
+		}
+
+		return "1619280060\n"
+	}
+
+	zoneBootTimes = func() map[string]float64 {
+		return map[string]float64{"cube-cron": 1619280030}
+	}
+
+	acc := testutil.Accumulator{}
+	dependencies := dependencyCache{}
+	s.gatherBootReadiness(&acc, svcs, dependencies)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			readinessMetric("cube-cron", map[string]interface{}{
+				"ready": 1, "pending": 0, "seconds_to_ready": float64(30),
+			}),
+			readinessMetric("cube-pkgsrc", map[string]interface{}{"ready": 0, "pending": 3}),
+			readinessMetric("global", map[string]interface{}{"ready": 1, "pending": 0}),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+
+	// The graph is shared with the rest of the collection, so svcs is only run once
+	s.gatherBootReadiness(&acc, svcs, dependencies)
+	assert.Equal(t, 1, calls)
+}
+
+func readinessMetric(zone string, fields map[string]interface{}) telegraf.Metric {
+	return testutil.MustMetric(
+		"smf",
+		map[string]string{
+			"zone":      zone,
+			"milestone": "multi-user-server",
+		},
+		fields,
+		time.Now(),
+	)
+}
+
+func TestGatherLogs(t *testing.T) {
+	s := &IllumosSmf{LogLines: 2}
+
+	logPathOutput = func(zone, fmri string) string {
+		return "/var/svc/log/" + strings.Replace(strings.TrimPrefix(fmri, "svc:/"), "/", "-", -1) +
+			".log"
+	}
+
+	tailed := []string{}
+	tailErr := errors.New("zlogin: zone cube-pkgsrc is not running")
+
+	logTail = func(zone, path string, lines int) (string, error) {
+		tailed = append(tailed, zone+":"+path)
+		assert.Equal(t, 2, lines)
+		return "[ Apr 24 15:20:01 Executing start method ]\nmount: /data: No such file", tailErr
+	}
+
+	// The log can't be read, so there is an error, and we try again next time
+	acc := testutil.Accumulator{}
+	s.gatherLogs(&acc, sampleSvcs(t))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+	require.Len(t, acc.Errors, 1)
+
+	tailErr = nil
+	s.gatherLogs(&acc, sampleSvcs(t))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"smf_log",
+				map[string]string{
+					"zone": "cube-pkgsrc",
+					"fmri": "svc:/system/filesystem/local:default",
+					"path": "/var/svc/log/system-filesystem-local:default.log",
+				},
+				map[string]interface{}{
+					"log": "[ Apr 24 15:20:01 Executing start method ]\nmount: /data: No such file",
+				},
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+
+	// Still in maintenance, so nothing more to say
+	acc.ClearMetrics()
+	s.gatherLogs(&acc, sampleSvcs(t))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+
+	// Back online, then into maintenance again
+	s.gatherLogs(&acc, []svc{})
+	s.gatherLogs(&acc, sampleSvcs(t))
+	assert.Len(t, acc.GetTelegrafMetrics(), 1)
+	assert.Equal(t, 3, len(tailed))
+	assert.Equal(t, "cube-pkgsrc:/var/svc/log/system-filesystem-local:default.log", tailed[0])
+}
+
+func TestGatherLogsBadPath(t *testing.T) {
+	s := &IllumosSmf{LogLines: 2}
+
+	logPathOutput = func(zone, fmri string) string {
+		return "svcs: Pattern 'svc:/system/filesystem/local:default' doesn't match any instances"
+	}
+
+	logTail = func(zone, path string, lines int) (string, error) {
+		t.Errorf("should not read %s", path)
+		return "", nil
+	}
+
+	acc := testutil.Accumulator{}
+	s.gatherLogs(&acc, sampleSvcs(t))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+	assert.Len(t, acc.Errors, 1)
+}
+
+func TestLogTailArgs(t *testing.T) {
+	assert.Equal(
+		t,
+		[]string{"/bin/tail", "-5", "/var/svc/log/system-cron:default.log"},
+		logTailArgs("global", "/var/svc/log/system-cron:default.log", 5))
+
+	// A path from another zone is only ever opened inside that zone, and can't escape the quotes
+	assert.Equal(
+		t,
+		[]string{"/usr/sbin/zlogin", "cube-pkgsrc", "/bin/tail", "-5", `'/../../../etc/shadow'`},
+		logTailArgs("cube-pkgsrc", "/../../../etc/shadow", 5))
+
+	assert.Equal(
+		t,
+		[]string{"/usr/sbin/zlogin", "cube-pkgsrc", "/bin/tail", "-5", `'/tmp/x'\''; cat /etc/shadow'`},
+		logTailArgs("cube-pkgsrc", "/tmp/x'; cat /etc/shadow", 5))
+
+	zoneName = "cube-pkgsrc"
+	defer func() { zoneName = "" }()
+
+	assert.Equal(
+		t,
+		[]string{"/bin/tail", "-5", "/var/svc/log/system-cron:default.log"},
+		logTailArgs("cube-pkgsrc", "/var/svc/log/system-cron:default.log", 5))
+}
+
+func sampleSvcs(t *testing.T) []svc {
+	svcs, errs := svcList(sampleOutput)
+	require.Empty(t, errs)
+
+	return svcs
+}
+
+var startPgSample = `start/exec astring /opt/puppet/bin/puppet agent --no-daemonize
+start/timeout_seconds count 300
+start/type astring method`
+
+var ngzSample = `online         svc:/system/cron:default
+maintenance    svc:/sysdef/puppet:default
+legacy_run     lrc:/etc/rc2_d/S89PRESERVE`
+
 var sampleOutput = `cube-pkgsrc      maintenance    svc:/system/filesystem/local:default
 cube-pkgsrc      online         svc:/system/filesystem/minimal:default
 cube-pkgsrc      online         svc:/system/manifest-import:default
@@ -157,3 +1055,104 @@ global           legacy_run     lrc:/etc/rc2_d/S20sysetup
 global           online         svc:/system/config-assemble:services
 global           online         svc:/sdef/diamond:default
 global           disabled       svc:/network/varpd:default`
+
+var svcsExplainSample = `svc:/system/filesystem/local:default (local file system mounts)
+ State: maintenance since Sat Apr 24 15:20:01 2021
+Reason: Start method exited with $SMF_EXIT_ERR_FATAL.
+   See: http://illumos.org/msg/SMF-8000-KS
+   See: man -M /usr/share/man -s 1M mountall
+   See: /var/svc/log/system-filesystem-local:default.log
+Impact: 3 dependent services are not running:
+        svc:/system/filesystem/reparse:default
+        svc:/network/shares/group:default
+        svc:/system/cron:default
+
+svc:/network/rpc/gss:default (Generic Security Service)
+ State: uninitialized since Sat Apr 24 15:19:58 2021
+Reason: Restarter svc:/network/inetd:default is not running.
+   See: http://illumos.org/msg/SMF-8000-5H
+   See: man -M /usr/share/man -s 1M gssd
+Impact: 1 dependent service is not running:
+        svc:/network/nfs/client:default
+
+svc:/application/pkgsrc/nginx:default (nginx)
+ State: maintenance since Sat Apr 24 15:22:40 2021
+Reason: Start method failed repeatedly, last exited with status 1.
+   See: http://illumos.org/msg/SMF-8000-KS
+   See: /var/svc/log/application-pkgsrc-nginx:default.log
+Impact: This service is not running.`
+
+var stateTimestampSample = `svc:/system/filesystem/local:default/:properties/restarter/state_timestamp time 1619280001.250000
+svc:/system/filesystem/minimal:default/:properties/restarter/state_timestamp time 1619194201.000000
+svc:/system/manifest-import:default/:properties/restarter/state_timestamp time 1619190601.500000
+svc:/system/svc/global:default/:properties/restarter/state_timestamp time not-a-time
+svcprop: Pattern 'lrc:/etc/rc2_d/S89PRESERVE' doesn't match any entities`
+
+var ctidSample = `cube-cron        64   svc:/system/cron:default
+cube-cron        71   svc:/sysdef/puppet:default
+cube-cron        -    svc:/system/device/audio:default
+global           12   svc:/system/cron:default
+`
+
+var svcsLongSample = `fmri         svc:/network/loopback:default
+name         loopback network interface
+enabled      true
+state        online
+next_state   none
+restarter    svc:/system/svc/restarter:default
+
+fmri         svc:/network/physical:default
+name         physical network interfaces
+enabled      true
+state        maintenance
+next_state   none
+restarter    svc:/system/svc/restarter:default
+dependency   require_all/none svc:/network/loopback (online)
+
+fmri         svc:/network/physical:nwam
+name         physical network interfaces
+enabled      false
+state        disabled
+next_state   none
+restarter    svc:/system/svc/restarter:default
+dependency   require_all/none svc:/network/loopback:default (online)
+
+fmri         svc:/milestone/network:default
+name         Network milestone
+enabled      true
+state        offline
+next_state   none
+dependency   require_all/none svc:/network/loopback svc:/network/physical (online maintenance)
+
+fmri         svc:/network/ssh:default
+name         SSH server
+enabled      true
+state        offline
+next_state   none
+logfile      /var/svc/log/network-ssh:default.log
+dependency   require_all/none svc:/milestone/network (offline)
+dependency   require_all/none file://localhost/etc/ssh/sshd_config (online)
+dependency   require_all/restart svc:/network/physical:default (maintenance)
+
+fmri         svc:/network/ntp:default
+name         Network Time Protocol (NTP) Version 4
+enabled      true
+state        offline
+next_state   none
+dependency   require_all/none svc:/milestone/network (offline)
+
+fmri         svc:/milestone/multi-user:default
+name         multi-user milestone
+enabled      true
+state        offline
+next_state   none
+dependency   require_all/none svc:/milestone/network (offline)
+dependency   optional_all/none svc:/milestone/multi-user-server:default (offline)
+
+fmri         svc:/milestone/multi-user-server:default
+name         multi-user plus exports milestone
+enabled      true
+state        offline
+next_state   none
+dependency   require_all/none svc:/milestone/multi-user (offline)
+`
@@ -3,23 +3,154 @@ package illumos_zones
 import (
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/siebenmann/go-kstat"
 	sth "github.com/snltd/solaris-telegraf-helpers"
+	"github.com/snltd/solaris-telegraf-plugins/internal/helpers"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (z *IllumosZones) Description() string {
 	return "Report on zone states, brands, and other properties."
 }
 
-var sampleConfig = ""
+var sampleConfig = `
+	## The zones you wish to report on. Globs are allowed. If this is unset or empty, all zones
+	## are reported
+	# zones = ["cube-*"]
+	## Zones you do not wish to report on, even if they match "zones"
+	# exclude_zones = ["*-test"]
+	## The zone brands you wish to report on. If this is unset or empty, all brands are reported
+	# brands = ["lipkg", "pkgsrc", "lx"]
+	## Whether to tag points with the zone's UUID
+	# uuid_tag = false
+	## Whether to tag points with the zone's zonepath
+	# zonepath_tag = false
+	## zonecfg(1M) attrs whose values you want as tags
+	# attr_tags = ["owner"]
+	## Whether to report the CPU usage and load of each zone
+	# cpu = false
+	## Whether to report the filesystem I/O of each zone, as vfsstat(1M) would
+	# vfs = false
+	## Whether to report the configuration of each non-global zone, from zonecfg(1M)
+	# config = false
+	## Whether to send a point each time a zone changes state, and the uptime of running zones
+	# lifecycle = false
+	## Whether to report the ZFS space used by each zone's zonepath and delegated datasets
+	# zfs = false
+`
 
-type IllumosZones struct{}
+type IllumosZones struct {
+	Zones        []string
+	ExcludeZones []string
+	Brands       []string
+	UuidTag      bool
+	ZonepathTag  bool
+	AttrTags     []string
+	Cpu          bool
+	Vfs          bool
+	Config       bool
+	Lifecycle    bool
+	Zfs          bool
+	// lastCpu holds the CPU counters of every zone when we last looked.
+	lastCpu map[string]counterSample
+	// lastVfs holds the VFS counters of every zone when we last looked.
+	lastVfs map[string]counterSample
+	// lastZones is every zone as it was when we last looked.
+	lastZones sth.ZoneMap
+	// zonecfgs holds the output of 'zonecfg info' for each zone, for the current collection.
+	zonecfgs map[string]string
+}
+
+// counterSample is a set of kstat counters, and when they were read.
+type counterSample struct {
+	snaptime int64
+	counters map[string]uint64
+}
+
+// zfsProperties are the columns we ask zfs(1M) for, after the name and mountpoint.
+var zfsProperties = []string{
+	"used", "available", "quota", "refquota", "reservation", "referenced",
+}
+
+// vfsCounters are the zone_vfs kstats we send as they are, and use to work out rates.
+var vfsCounters = []string{
+	"reads", "writes", "nread", "nwritten", "rtime", "wtime", "rlentime", "wlentime",
+	"10ms_ops", "100ms_ops", "1s_ops", "10s_ops",
+}
 
 var makeZoneMap = func() sth.ZoneMap {
 	return sth.NewZoneMap()
 }
 
+var zoneBootTimes = helpers.ZoneBootTimes
+
+var zfsListOutput = func() string {
+	return sth.RunCmd("/usr/sbin/zfs list -Hp -t filesystem -o name,mountpoint," +
+		strings.Join(zfsProperties, ","))
+}
+
+var now = time.Now
+
+var zonecfgOutput = func(zone string) string {
+	return sth.RunCmd("/usr/sbin/zonecfg -z " + zone + " info")
+}
+
 func (z *IllumosZones) Gather(acc telegraf.Accumulator) error {
-	gatherProperties(z, acc, makeZoneMap())
+	zonemap := z.filterZones(makeZoneMap())
+	z.zonecfgs = make(map[string]string)
+	gatherProperties(z, acc, zonemap)
+
+	if z.Lifecycle {
+		z.trackTransitions(acc, zonemap)
+	}
+
+	if z.Config {
+		z.gatherConfig(acc, zonemap)
+	}
+
+	if z.Zfs {
+		z.gatherZfs(acc, zonemap, parseZfsList(zfsListOutput()))
+	}
+
+	if !z.Cpu && !z.Vfs {
+		return nil
+	}
+
+	token, err := kstat.Open()
+
+	if err != nil {
+		log.Fatal("cannot get kstat token")
+	}
+
+	if z.Cpu {
+		for _, ks := range sth.KstatClass(token, "zone_misc") {
+			stats, err := ks.AllNamed()
+
+			if err != nil {
+				continue
+			}
+
+			z.gatherCpu(acc, ks, stats, zonemap)
+		}
+	}
+
+	if z.Vfs {
+		for _, ks := range sth.KstatClass(token, "zone_vfs") {
+			stats, err := ks.AllNamed()
+
+			if err != nil {
+				continue
+			}
+
+			z.gatherVfs(acc, ks, stats, zonemap)
+		}
+	}
+
+	token.Close()
+
 	return nil
 }
 
@@ -32,18 +163,529 @@ func running(state string) int {
 }
 
 // Create an "I am here" metric for each zone. Value is 1 if the zone is running, 0 if it's not.
+// With Lifecycle on, running zones also get their uptime.
 func gatherProperties(z *IllumosZones, acc telegraf.Accumulator, zonemap sth.ZoneMap) {
+	var bootTimes map[string]float64
+
+	if z.Lifecycle {
+		bootTimes = zoneBootTimes()
+	}
+
+	timeNow := float64(now().UnixNano()) / 1e9
+
+	for zone, zoneData := range zonemap {
+		fields := map[string]interface{}{"status": running(zoneData.Status)}
+
+		if bootTime, ok := bootTimes[zone]; ok && zoneData.Status == "running" {
+			fields["uptime"] = timeNow - bootTime
+		}
+
+		acc.AddFields("zones", fields, z.zoneTags(zone, zonemap))
+	}
+}
+
+// trackTransitions compares the state of each zone with its state last time, and sends a point
+// for each one which has changed. A zone which was running both times, but has a new zone ID,
+// rebooted in between, and is reported as going from running to running. Zones which appear or
+// disappear, as they do when they are created or deleted, are not reported.
+func (z *IllumosZones) trackTransitions(acc telegraf.Accumulator, zonemap sth.ZoneMap) {
+	for zone, zoneData := range zonemap {
+		last, seen := z.lastZones[zone]
+
+		if !seen {
+			continue
+		}
+
+		rebooted := zoneData.Status == "running" && last.Status == "running" &&
+			zoneData.Id != last.Id
+
+		if last.Status == zoneData.Status && !rebooted {
+			continue
+		}
+
+		tags := z.zoneTags(zone, zonemap)
+		delete(tags, "status")
+		tags["from_state"] = last.Status
+		tags["to_state"] = zoneData.Status
+
+		acc.AddFields("zones", map[string]interface{}{"transitions": 1}, tags)
+	}
+
+	z.lastZones = zonemap
+}
+
+// zoneTags gives the tags which go on every point describing a zone. Attr tags never replace the
+// standard ones.
+func (z *IllumosZones) zoneTags(zone string, zonemap sth.ZoneMap) map[string]string {
+	zoneData := zonemap[zone]
+
+	tags := map[string]string{
+		"name":   zone,
+		"status": zoneData.Status,
+		"ipType": zoneData.IpType,
+		"brand":  zoneData.Brand,
+	}
+
+	if z.UuidTag && zoneData.Uuid != "" {
+		tags["uuid"] = zoneData.Uuid
+	}
+
+	if z.ZonepathTag {
+		tags["zonepath"] = zoneData.Path
+	}
+
+	if len(z.AttrTags) > 0 && zone != "global" {
+		attrs := parseZonecfgAttrs(z.zonecfg(zone))
+
+		for _, attr := range z.AttrTags {
+			if _, clash := tags[attr]; clash {
+				continue
+			}
+
+			if value, ok := attrs[attr]; ok {
+				tags[attr] = value
+			}
+		}
+	}
+
+	return tags
+}
+
+// filterZones removes from the zone map any zones we were not asked to report on.
+func (z *IllumosZones) filterZones(zonemap sth.ZoneMap) sth.ZoneMap {
+	ret := sth.ZoneMap{}
+
+	for zone, zoneData := range zonemap {
+		if len(z.Zones) > 0 && !helpers.MatchesAny(zone, z.Zones) {
+			continue
+		}
+
+		if helpers.MatchesAny(zone, z.ExcludeZones) || !sth.WeWant(zoneData.Brand, z.Brands) {
+			continue
+		}
+
+		ret[zone] = zoneData
+	}
+
+	return ret
+}
+
+// zonecfg gets the output of 'zonecfg info' for a zone, running it at most once per collection.
+func (z *IllumosZones) zonecfg(zone string) string {
+	if z.zonecfgs == nil {
+		z.zonecfgs = make(map[string]string)
+	}
+
+	raw, ok := z.zonecfgs[zone]
+
+	if !ok {
+		raw = zonecfgOutput(zone)
+		z.zonecfgs[zone] = raw
+	}
+
+	return raw
+}
+
+// gatherConfig sends a point describing the configuration of each non-global zone. The global
+// zone is not configured with zonecfg(1M), so has nothing to say.
+func (z *IllumosZones) gatherConfig(acc telegraf.Accumulator, zonemap sth.ZoneMap) {
+	for zone, zoneData := range zonemap {
+		if zone == "global" {
+			continue
+		}
+
+		fields := parseZonecfg(z.zonecfg(zone))
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		fields["uuid"] = zoneData.Uuid
+		acc.AddFields("zones.config", fields, z.zoneTags(zone, zonemap))
+	}
+}
+
+// parseZonecfg pulls the properties we care about out of the output of 'zonecfg info'. Global
+// properties are at the start of a line. A resource is a line ending in a colon, followed by its
+// properties, indented. Properties which are set indirectly, like cpu-shares or capped-memory's
+// swap, are shown in square brackets. Unset properties are left out.
+func parseZonecfg(raw string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	counts := map[string]int{"net": 0, "dataset": 0, "fs": 0}
+	resource := ""
+
+	for _, line := range strings.Split(raw, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indented := strings.HasPrefix(line, "\t") || strings.HasPrefix(line, " ")
+		line = strings.Trim(strings.TrimSpace(line), "[]")
+		chunks := strings.SplitN(line, ":", 2)
+
+		if len(chunks) != 2 {
+			continue
+		}
+
+		key, value := chunks[0], strings.TrimSpace(chunks[1])
+
+		if !indented {
+			resource = ""
+
+			if value == "" {
+				resource = key
+
+				if _, counted := counts[resource]; counted {
+					counts[resource]++
+				}
+
+				continue
+			}
+		}
+
+		if value == "" {
+			continue
+		}
+
+		switch resource + "/" + key {
+		case "/zonepath", "/pool", "/limitpriv":
+			fields[key] = value
+		case "/autoboot":
+			fields["autoboot"] = boolToInt(value == "true")
+		case "/cpu-shares":
+			if shares, err := strconv.Atoi(value); err == nil {
+				fields["cpu_shares"] = shares
+			}
+		case "capped-memory/physical", "capped-memory/swap", "capped-memory/locked":
+			if bytes, err := sth.Bytify(value); err == nil {
+				fields["capped_memory_"+key] = bytes
+			}
+		case "capped-cpu/ncpus":
+			if ncpus, err := strconv.ParseFloat(value, 64); err == nil {
+				fields["capped_cpu_ncpus"] = ncpus
+			}
+		case "dedicated-cpu/ncpus":
+			fields["dedicated_cpu_ncpus"] = value
+		}
+	}
+
+	if len(fields) == 0 {
+		return fields
+	}
+
+	for resource, count := range counts {
+		fields[resource+"_resources"] = count
+	}
+
+	return fields
+}
+
+// zfsDataset is a line of 'zfs list' output.
+type zfsDataset struct {
+	name       string
+	mountpoint string
+	props      map[string]int64
+}
+
+// gatherZfs sends a point for the dataset at each non-global zone's zonepath, and each dataset
+// delegated to the zone. As well as the raw numbers, we work out how full each quota is, so you
+// can alert before a zone runs out of space.
+func (z *IllumosZones) gatherZfs(
+	acc telegraf.Accumulator,
+	zonemap sth.ZoneMap,
+	datasets []zfsDataset) {
+	byName := make(map[string]zfsDataset)
+	byMountpoint := make(map[string]zfsDataset)
+
+	for _, dataset := range datasets {
+		byName[dataset.name] = dataset
+		byMountpoint[dataset.mountpoint] = dataset
+	}
+
 	for zone, zoneData := range zonemap {
-		acc.AddFields(
-			"zones",
-			map[string]interface{}{"status": running(zoneData.Status)},
-			map[string]string{
-				"name":   zone,
-				"status": zoneData.Status,
-				"ipType": zoneData.IpType,
-				"brand":  zoneData.Brand,
-			})
+		if zone == "global" {
+			continue
+		}
+
+		if dataset, ok := byMountpoint[zoneData.Path]; ok {
+			z.addZfsPoint(acc, zone, zonemap, dataset, "zonepath")
+		}
+
+		for _, name := range parseZonecfgDatasets(z.zonecfg(zone)) {
+			if dataset, ok := byName[name]; ok {
+				z.addZfsPoint(acc, zone, zonemap, dataset, "delegated")
+			}
+		}
+	}
+}
+
+func (z *IllumosZones) addZfsPoint(
+	acc telegraf.Accumulator,
+	zone string,
+	zonemap sth.ZoneMap,
+	dataset zfsDataset,
+	role string) {
+	fields := make(map[string]interface{})
+
+	for prop, value := range dataset.props {
+		fields[prop] = value
+	}
+
+	if quota := dataset.props["quota"]; quota > 0 {
+		fields["quota_used_pct"] = float64(dataset.props["used"]) / float64(quota) * 100
+	}
+
+	if refquota := dataset.props["refquota"]; refquota > 0 {
+		fields["refquota_used_pct"] =
+			float64(dataset.props["referenced"]) / float64(refquota) * 100
+	}
+
+	tags := z.zoneTags(zone, zonemap)
+	tags["dataset"] = dataset.name
+	tags["role"] = role
+
+	acc.AddFields("zones.zfs", fields, tags)
+}
+
+// parseZfsList turns the tab-separated output of 'zfs list -Hp' into a list of datasets. Values
+// which are not numbers, like the "-" zfs uses for properties which do not apply, are left out.
+func parseZfsList(raw string) []zfsDataset {
+	var ret []zfsDataset
+
+	for _, line := range strings.Split(raw, "\n") {
+		chunks := strings.Split(line, "\t")
+
+		if len(chunks) != len(zfsProperties)+2 {
+			continue
+		}
+
+		dataset := zfsDataset{
+			name:       chunks[0],
+			mountpoint: chunks[1],
+			props:      make(map[string]int64),
+		}
+
+		for i, prop := range zfsProperties {
+			if value, err := strconv.ParseInt(chunks[i+2], 10, 64); err == nil {
+				dataset.props[prop] = value
+			}
+		}
+
+		ret = append(ret, dataset)
 	}
+
+	return ret
+}
+
+// parseZonecfgDatasets gets the names of the datasets delegated to a zone from the output of
+// 'zonecfg info'.
+func parseZonecfgDatasets(raw string) []string {
+	var ret []string
+	inDataset := false
+
+	for _, line := range strings.Split(raw, "\n") {
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			inDataset = strings.TrimSpace(line) == "dataset:"
+			continue
+		}
+
+		chunks := strings.SplitN(strings.TrimSpace(line), ":", 2)
+
+		if inDataset && len(chunks) == 2 && chunks[0] == "name" {
+			ret = append(ret, strings.TrimSpace(chunks[1]))
+		}
+	}
+
+	return ret
+}
+
+// parseZonecfgAttrs pulls the name and value of each attr resource out of the output of
+// 'zonecfg info'.
+func parseZonecfgAttrs(raw string) map[string]string {
+	ret := make(map[string]string)
+	var name string
+	inAttr := false
+
+	for _, line := range strings.Split(raw, "\n") {
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			inAttr = strings.TrimSpace(line) == "attr:"
+			name = ""
+			continue
+		}
+
+		chunks := strings.SplitN(strings.TrimSpace(line), ":", 2)
+
+		if !inAttr || len(chunks) != 2 {
+			continue
+		}
+
+		switch chunks[0] {
+		case "name":
+			name = strings.TrimSpace(chunks[1])
+		case "value":
+			if name != "" {
+				ret[name] = strings.TrimSpace(chunks[1])
+			}
+		}
+	}
+
+	return ret
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// gatherCpu sends the CPU usage of a zone, from its zones:<zoneid>:<zonename> kstat, which is in
+// the "zone_misc" class. The nsec_ counters are turned into CPU-seconds per second, which needs
+// two samples, so they are not sent on the first run. The load averages are fixed-point numbers,
+// with eight bits after the point.
+func (z *IllumosZones) gatherCpu(
+	acc telegraf.Accumulator,
+	ks *kstat.KStat,
+	stats []*kstat.Named,
+	zonemap sth.ZoneMap) {
+	if z.lastCpu == nil {
+		z.lastCpu = make(map[string]counterSample)
+	}
+
+	zone := ks.Name
+	fields := make(map[string]interface{})
+	sample := counterSample{snaptime: ks.Snaptime, counters: make(map[string]uint64)}
+
+	for _, stat := range stats {
+		switch {
+		case stat.Name == "zonename":
+			zone = stat.StringVal
+		case stat.Name == "nsec_user" || stat.Name == "nsec_sys" || stat.Name == "nsec_waitrq":
+			sample.counters[strings.TrimPrefix(stat.Name, "nsec_")] = stat.UintVal
+		case strings.HasPrefix(stat.Name, "avenrun_"):
+			fields[stat.Name] = float64(stat.UintVal) / 256
+		case strings.HasPrefix(stat.Name, "forkfail") || stat.Name == "mapfail":
+			fields[stat.Name] = stat.UintVal
+		}
+	}
+
+	if _, wanted := zonemap[zone]; !wanted {
+		return
+	}
+
+	last, seen := z.lastCpu[zone]
+	z.lastCpu[zone] = sample
+
+	if seen {
+		if deltas, elapsed, ok := counterDeltas(last, sample); ok {
+			for name, delta := range deltas {
+				fields[name] = float64(delta) / elapsed
+			}
+		}
+	}
+
+	if len(fields) == 0 {
+		return
+	}
+
+	acc.AddFields("zones.cpu", fields, z.zoneTags(zone, zonemap))
+}
+
+// gatherVfs sends the filesystem I/O of a zone, from its zone_vfs kstat. The raw counters are
+// always sent. From the second run on, we also work out what vfsstat(1M) would show: operations
+// and bytes per second, the average number of operations in progress, how long each took, and
+// how much of the time there was something in progress.
+func (z *IllumosZones) gatherVfs(
+	acc telegraf.Accumulator,
+	ks *kstat.KStat,
+	stats []*kstat.Named,
+	zonemap sth.ZoneMap) {
+	if z.lastVfs == nil {
+		z.lastVfs = make(map[string]counterSample)
+	}
+
+	zone := ks.Name
+	fields := make(map[string]interface{})
+	sample := counterSample{snaptime: ks.Snaptime, counters: make(map[string]uint64)}
+
+	for _, stat := range stats {
+		if stat.Name == "zonename" {
+			zone = stat.StringVal
+		} else if sth.WeWant(stat.Name, vfsCounters) {
+			sample.counters[stat.Name] = stat.UintVal
+			fields[stat.Name] = stat.UintVal
+		}
+	}
+
+	if _, wanted := zonemap[zone]; !wanted || len(fields) == 0 {
+		return
+	}
+
+	last, seen := z.lastVfs[zone]
+	z.lastVfs[zone] = sample
+
+	if seen {
+		for name, value := range vfsRates(last, sample) {
+			fields[name] = value
+		}
+	}
+
+	acc.AddFields("zones.vfs", fields, z.zoneTags(zone, zonemap))
+}
+
+// vfsRates turns two samples of zone_vfs counters into the numbers vfsstat(1M) shows. The times
+// are in nanoseconds. Latencies are only given when there were operations to measure.
+func vfsRates(last, now counterSample) map[string]float64 {
+	ret := make(map[string]float64)
+	deltas, elapsed, ok := counterDeltas(last, now)
+
+	if !ok {
+		return ret
+	}
+
+	ret["reads_per_sec"] = float64(deltas["reads"]) / elapsed * 1e9
+	ret["writes_per_sec"] = float64(deltas["writes"]) / elapsed * 1e9
+	ret["read_bytes_per_sec"] = float64(deltas["nread"]) / elapsed * 1e9
+	ret["write_bytes_per_sec"] = float64(deltas["nwritten"]) / elapsed * 1e9
+	ret["read_actv"] = float64(deltas["rlentime"]) / elapsed
+	ret["write_actv"] = float64(deltas["wlentime"]) / elapsed
+	ret["read_busy_pct"] = float64(deltas["rtime"]) / elapsed * 100
+	ret["write_busy_pct"] = float64(deltas["wtime"]) / elapsed * 100
+
+	if deltas["reads"] > 0 {
+		ret["read_latency_us"] = float64(deltas["rlentime"]) / float64(deltas["reads"]) / 1e3
+	}
+
+	if deltas["writes"] > 0 {
+		ret["write_latency_us"] = float64(deltas["wlentime"]) / float64(deltas["writes"]) / 1e3
+	}
+
+	return ret
+}
+
+// counterDeltas works out how much each counter moved between two samples, and the nanoseconds
+// between them. If time stood still, or a counter went backwards, most likely because the zone
+// rebooted, there is nothing sensible to say, and the final value is false.
+func counterDeltas(last, now counterSample) (map[string]uint64, float64, bool) {
+	deltas := make(map[string]uint64)
+	elapsed := now.snaptime - last.snaptime
+
+	if elapsed <= 0 {
+		return deltas, 0, false
+	}
+
+	for name, value := range now.counters {
+		lastValue, ok := last.counters[name]
+
+		if !ok || value < lastValue {
+			return deltas, 0, false
+		}
+
+		deltas[name] = value - lastValue
+	}
+
+	return deltas, float64(elapsed), true
 }
 
 func (z *IllumosZones) SampleConfig() string {
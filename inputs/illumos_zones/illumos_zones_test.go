@@ -3,8 +3,11 @@ package illumos_zones
 import (
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/siebenmann/go-kstat"
 	sth "github.com/snltd/solaris-telegraf-helpers"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,6 +30,510 @@ func TestPlugin(t *testing.T) {
 		testutil.IgnoreTime())
 }
 
+func TestGatherCpu(t *testing.T) {
+	z := &IllumosZones{Cpu: true}
+	zonemap := sth.ParseZones(zoneadmOutput)
+	acc := testutil.Accumulator{}
+	ks := &kstat.KStat{
+		Module:   "zones",
+		Instance: 42,
+		Name:     "cube-media",
+		Class:    "zone_misc",
+		Snaptime: 10000000000,
+	}
+
+	z.gatherCpu(&acc, ks, cpuStats(1000000000, 500000000, 0, 512), zonemap)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			cpuMetric(map[string]interface{}{
+				"avenrun_1min":    2.0,
+				"forkfail_nomem":  uint64(0),
+				"forkfail_noproc": uint64(3),
+				"mapfail":         uint64(1),
+			}),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+
+	acc.ClearMetrics()
+	ks.Snaptime = 12000000000
+	z.gatherCpu(&acc, ks, cpuStats(4000000000, 1500000000, 100000000, 320), zonemap)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			cpuMetric(map[string]interface{}{
+				"avenrun_1min":    1.25,
+				"forkfail_nomem":  uint64(0),
+				"forkfail_noproc": uint64(3),
+				"mapfail":         uint64(1),
+				"user":            1.5,
+				"sys":             0.5,
+				"waitrq":          0.05,
+			}),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestCounterDeltas(t *testing.T) {
+	last := counterSample{snaptime: 1000, counters: map[string]uint64{"user": 500, "sys": 200}}
+
+	deltas, elapsed, ok := counterDeltas(
+		last, counterSample{snaptime: 3000, counters: map[string]uint64{"user": 1000, "sys": 200}})
+
+	assert.True(t, ok)
+	assert.Equal(t, 2000.0, elapsed)
+	assert.Equal(t, map[string]uint64{"user": 500, "sys": 0}, deltas)
+
+	_, _, ok = counterDeltas(last, counterSample{snaptime: 1000, counters: last.counters})
+	assert.False(t, ok)
+
+	_, _, ok = counterDeltas(
+		last, counterSample{snaptime: 3000, counters: map[string]uint64{"user": 100, "sys": 300}})
+	assert.False(t, ok)
+}
+
+func TestGatherVfs(t *testing.T) {
+	z := &IllumosZones{Vfs: true}
+	zonemap := sth.ParseZones(zoneadmOutput)
+	acc := testutil.Accumulator{}
+	ks := &kstat.KStat{Module: "zone_vfs", Instance: 42, Name: "cube-media", Snaptime: 1e10}
+
+	z.gatherVfs(&acc, ks, vfsStats(100, 1000000, 2e8, 4e8, 2), zonemap)
+
+	fields := map[string]interface{}{
+		"reads": uint64(100), "writes": uint64(50), "nread": uint64(1000000),
+		"nwritten": uint64(256000), "rtime": uint64(2e8), "wtime": uint64(1e8),
+		"rlentime": uint64(4e8), "wlentime": uint64(1e8), "10ms_ops": uint64(2),
+		"100ms_ops": uint64(1), "1s_ops": uint64(0), "10s_ops": uint64(0),
+	}
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{testutil.MustMetric("zones.vfs", cubeMediaTags, fields, time.Now())},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+
+	acc.ClearMetrics()
+	ks.Snaptime = 1.2e10
+	z.gatherVfs(&acc, ks, vfsStats(500, 5000000, 1.2e9, 2.4e9, 5), zonemap)
+
+	metric := acc.GetTelegrafMetrics()[0]
+	assert.Equal(t, "zones.vfs", metric.Name())
+	assert.Equal(t, cubeMediaTags, metric.Tags())
+
+	expected := map[string]float64{
+		"reads_per_sec":       200,
+		"writes_per_sec":      0,
+		"read_bytes_per_sec":  2000000,
+		"write_bytes_per_sec": 0,
+		"read_actv":           1,
+		"write_actv":          0,
+		"read_busy_pct":       50,
+		"write_busy_pct":      0,
+		"read_latency_us":     5000,
+	}
+
+	for field, value := range expected {
+		actual, ok := metric.GetField(field)
+		require.True(t, ok, field)
+		assert.InDelta(t, value, actual, 0.0001, field)
+	}
+
+	_, ok := metric.GetField("write_latency_us")
+	assert.False(t, ok)
+	assert.Equal(t, uint64(5), metric.Fields()["10ms_ops"])
+}
+
+func vfsStats(reads, nread, rtime, rlentime, ops10ms uint64) []*kstat.Named {
+	return []*kstat.Named{
+		{Name: "zonename", Type: kstat.String, StringVal: "cube-media"},
+		{Name: "reads", Type: kstat.Uint64, UintVal: reads},
+		{Name: "writes", Type: kstat.Uint64, UintVal: 50},
+		{Name: "nread", Type: kstat.Uint64, UintVal: nread},
+		{Name: "nwritten", Type: kstat.Uint64, UintVal: 256000},
+		{Name: "rtime", Type: kstat.Uint64, UintVal: rtime},
+		{Name: "wtime", Type: kstat.Uint64, UintVal: 1e8},
+		{Name: "rlentime", Type: kstat.Uint64, UintVal: rlentime},
+		{Name: "wlentime", Type: kstat.Uint64, UintVal: 1e8},
+		{Name: "rcnt", Type: kstat.Uint32, UintVal: 1},
+		{Name: "10ms_ops", Type: kstat.Uint64, UintVal: ops10ms},
+		{Name: "100ms_ops", Type: kstat.Uint64, UintVal: 1},
+		{Name: "1s_ops", Type: kstat.Uint64, UintVal: 0},
+		{Name: "10s_ops", Type: kstat.Uint64, UintVal: 0},
+	}
+}
+
+var cubeMediaTags = map[string]string{
+	"name":   "cube-media",
+	"status": "running",
+	"ipType": "excl",
+	"brand":  "lipkg",
+}
+
+func cpuStats(user, sys, waitrq, avenrun uint64) []*kstat.Named {
+	return []*kstat.Named{
+		{Name: "zonename", Type: kstat.String, StringVal: "cube-media"},
+		{Name: "nsec_user", Type: kstat.Uint64, UintVal: user},
+		{Name: "nsec_sys", Type: kstat.Uint64, UintVal: sys},
+		{Name: "nsec_waitrq", Type: kstat.Uint64, UintVal: waitrq},
+		{Name: "avenrun_1min", Type: kstat.Uint32, UintVal: avenrun},
+		{Name: "forkfail_noproc", Type: kstat.Uint64, UintVal: 3},
+		{Name: "forkfail_nomem", Type: kstat.Uint64, UintVal: 0},
+		{Name: "mapfail", Type: kstat.Uint64, UintVal: 1},
+		{Name: "boot_time", Type: kstat.Uint64, UintVal: 1619270000},
+	}
+}
+
+func cpuMetric(fields map[string]interface{}) telegraf.Metric {
+	return testutil.MustMetric(
+		"zones.cpu",
+		cubeMediaTags,
+		fields,
+		time.Now(),
+	)
+}
+
+func TestGatherConfig(t *testing.T) {
+	zonemap := sth.ParseZones(zoneadmOutput)
+	asked := []string{}
+
+	zonecfgOutput = func(zone string) string {
+		asked = append(asked, zone)
+
+		if zone == "cube-media" {
+			return zonecfgSample
+		}
+
+		return ""
+	}
+
+	acc := testutil.Accumulator{}
+	z := &IllumosZones{}
+	z.gatherConfig(&acc, zonemap)
+
+	assert.ElementsMatch(t, []string{"cube-media", "cube-ws"}, asked)
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"zones.config",
+				cubeMediaTags,
+				map[string]interface{}{
+					"uuid":                   "c624d04f-d0d9-e1e6-822e-acebc78ec9ff",
+					"zonepath":               "/zones/cube-media",
+					"autoboot":               1,
+					"pool":                   "pool_media",
+					"limitpriv":              "default,dtrace_proc,dtrace_user",
+					"cpu_shares":             20,
+					"capped_memory_physical": float64(2147483648),
+					"capped_memory_swap":     float64(4294967296),
+					"capped_cpu_ncpus":       1.5,
+					"dedicated_cpu_ncpus":    "1-2",
+					"net_resources":          2,
+					"dataset_resources":      1,
+					"fs_resources":           0,
+				},
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestTrackTransitions(t *testing.T) {
+	z := &IllumosZones{Lifecycle: true}
+	acc := testutil.Accumulator{}
+
+	z.trackTransitions(&acc, sth.ParseZones(zoneadmOutput))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+
+	later := `0:global:running:/::ipkg:shared:0
+47:cube-media:running:/zones/cube-media:c624d04f-d0d9-e1e6-822e-acebc78ec9ff:lipkg:excl:128
+-:cube-ws:ready:/zones/cube-ws:0f9c56f4-9810-6d45-f801-d34bf27cc13f:pkgsrc:excl:179
+-:cube-new:configured:/zones/cube-new::pkgsrc:excl:0`
+
+	z.trackTransitions(&acc, sth.ParseZones(later))
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			transitionMetric("cube-media", "lipkg", "running", "running"),
+			transitionMetric("cube-ws", "pkgsrc", "installed", "ready"),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+
+	acc.ClearMetrics()
+	z.trackTransitions(&acc, sth.ParseZones(later))
+	assert.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestUptime(t *testing.T) {
+	z := &IllumosZones{Lifecycle: true}
+
+	zoneBootTimes = func() map[string]float64 {
+		return map[string]float64{"global": 1618800000, "cube-media": 1618866000.5}
+	}
+
+	now = func() time.Time { return time.Unix(1618866586, 0) }
+
+	acc := testutil.Accumulator{}
+	gatherProperties(z, &acc, sth.ParseZones(zoneadmOutput))
+
+	uptimes := make(map[string]interface{})
+
+	for _, metric := range acc.GetTelegrafMetrics() {
+		if uptime, ok := metric.GetField("uptime"); ok {
+			uptimes[metric.Tags()["name"]] = uptime
+		}
+	}
+
+	assert.Equal(t, map[string]interface{}{"global": 66586.0, "cube-media": 585.5}, uptimes)
+}
+
+func transitionMetric(zone, brand, from, to string) telegraf.Metric {
+	return testutil.MustMetric(
+		"zones",
+		map[string]string{
+			"name":       zone,
+			"brand":      brand,
+			"ipType":     "excl",
+			"from_state": from,
+			"to_state":   to,
+		},
+		map[string]interface{}{
+			"transitions": 1,
+		},
+		time.Now(),
+	)
+}
+
+func TestFilterZones(t *testing.T) {
+	zonemap := sth.ParseZones(zoneadmOutput)
+
+	names := func(z *IllumosZones) []string {
+		ret := []string{}
+
+		for zone := range z.filterZones(zonemap) {
+			ret = append(ret, zone)
+		}
+
+		return ret
+	}
+
+	assert.ElementsMatch(t, []string{"global", "cube-media", "cube-ws"}, names(&IllumosZones{}))
+	assert.ElementsMatch(t, []string{"cube-media", "cube-ws"}, names(&IllumosZones{
+		Zones: []string{"cube-*"},
+	}))
+	assert.ElementsMatch(t, []string{"global", "cube-ws"}, names(&IllumosZones{
+		ExcludeZones: []string{"*-media"},
+	}))
+	assert.ElementsMatch(t, []string{"cube-ws"}, names(&IllumosZones{
+		Zones:  []string{"cube-*"},
+		Brands: []string{"pkgsrc", "ipkg"},
+	}))
+}
+
+func TestZoneTags(t *testing.T) {
+	zonemap := sth.ParseZones(zoneadmOutput)
+	calls := 0
+
+	zonecfgOutput = func(zone string) string {
+		calls++
+		return zonecfgSample
+	}
+
+	z := &IllumosZones{
+		UuidTag:     true,
+		ZonepathTag: true,
+		AttrTags:    []string{"owner", "name", "missing"},
+	}
+
+	expected := map[string]string{
+		"name":     "cube-media",
+		"status":   "running",
+		"ipType":   "excl",
+		"brand":    "lipkg",
+		"uuid":     "c624d04f-d0d9-e1e6-822e-acebc78ec9ff",
+		"zonepath": "/zones/cube-media",
+		"owner":    "media-team",
+	}
+
+	assert.Equal(t, expected, z.zoneTags("cube-media", zonemap))
+	assert.Equal(t, expected, z.zoneTags("cube-media", zonemap))
+	assert.Equal(t, 1, calls)
+
+	assert.Equal(
+		t,
+		map[string]string{
+			"name":     "global",
+			"status":   "running",
+			"ipType":   "shared",
+			"brand":    "ipkg",
+			"zonepath": "/",
+		},
+		z.zoneTags("global", zonemap))
+}
+
+func TestParseZonecfgAttrs(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string]string{"owner": "media-team", "tier": "gold"},
+		parseZonecfgAttrs(zonecfgSample+"\nattr:\n\tname: tier\n\ttype: string\n\tvalue: gold"))
+
+	assert.Empty(t, parseZonecfgAttrs(""))
+}
+
+func TestGatherZfs(t *testing.T) {
+	zonemap := sth.ParseZones(zoneadmOutput)
+
+	zonecfgOutput = func(zone string) string {
+		if zone == "cube-media" {
+			return zonecfgSample
+		}
+
+		return "zonename: " + zone
+	}
+
+	z := &IllumosZones{}
+	acc := testutil.Accumulator{}
+	z.gatherZfs(&acc, zonemap, parseZfsList(zfsListSample))
+
+	mediaZonepath := copyTags(cubeMediaTags)
+	mediaZonepath["dataset"] = "rpool/zones/cube-media"
+	mediaZonepath["role"] = "zonepath"
+
+	mediaDelegated := copyTags(cubeMediaTags)
+	mediaDelegated["dataset"] = "fast/zone/media"
+	mediaDelegated["role"] = "delegated"
+
+	testutil.RequireMetricsEqual(
+		t,
+		[]telegraf.Metric{
+			testutil.MustMetric(
+				"zones.zfs",
+				mediaDelegated,
+				map[string]interface{}{
+					"used":           int64(75161927680),
+					"available":      int64(32212254720),
+					"quota":          int64(107374182400),
+					"refquota":       int64(0),
+					"reservation":    int64(0),
+					"referenced":     int64(75161927680),
+					"quota_used_pct": 70.0,
+				},
+				time.Now(),
+			),
+			testutil.MustMetric(
+				"zones.zfs",
+				mediaZonepath,
+				map[string]interface{}{
+					"used":              int64(4294967296),
+					"available":         int64(6442450944),
+					"quota":             int64(0),
+					"refquota":          int64(8589934592),
+					"reservation":       int64(1073741824),
+					"referenced":        int64(2147483648),
+					"refquota_used_pct": 25.0,
+				},
+				time.Now(),
+			),
+		},
+		acc.GetTelegrafMetrics(),
+		testutil.SortMetrics(),
+		testutil.IgnoreTime())
+}
+
+func TestParseZfsList(t *testing.T) {
+	datasets := parseZfsList("rpool\t/rpool\t100\t200\t0\t0\t-\t50\nrubbish")
+
+	assert.Equal(
+		t,
+		[]zfsDataset{
+			{
+				name:       "rpool",
+				mountpoint: "/rpool",
+				props: map[string]int64{
+					"used": 100, "available": 200, "quota": 0, "refquota": 0, "referenced": 50,
+				},
+			},
+		},
+		datasets)
+}
+
+func TestParseZonecfgDatasets(t *testing.T) {
+	assert.Equal(t, []string{"fast/zone/media"}, parseZonecfgDatasets(zonecfgSample))
+	assert.Empty(t, parseZonecfgDatasets("zonename: cube-ws"))
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	ret := make(map[string]string)
+
+	for k, v := range tags {
+		ret[k] = v
+	}
+
+	return ret
+}
+
+var zfsListSample = strings.Join([]string{
+	"rpool\t/rpool\t53687091200\t32212254720\t0\t0\t0\t98304",
+	"rpool/zones\t/zones\t10737418240\t32212254720\t0\t0\t0\t98304",
+	"rpool/zones/cube-media\t/zones/cube-media\t4294967296\t6442450944\t0\t8589934592\t" +
+		"1073741824\t2147483648",
+	"fast/zone/media\t/fast/zone/media\t75161927680\t32212254720\t107374182400\t0\t0\t" +
+		"75161927680",
+	"fast/zone/other\t/fast/zone/other\t1024\t32212254720\t0\t0\t0\t1024",
+}, "\n")
+
+var zonecfgSample = `zonename: cube-media
+zonepath: /zones/cube-media
+brand: lipkg
+autoboot: true
+autoshutdown: shutdown
+bootargs:
+pool: pool_media
+limitpriv: default,dtrace_proc,dtrace_user
+scheduling-class:
+ip-type: exclusive
+hostid:
+fs-allowed:
+[cpu-shares: 20]
+net:
+	address not specified
+	allowed-address not specified
+	physical: media_net0
+	defrouter not specified
+net:
+	address not specified
+	allowed-address not specified
+	physical: media_net1
+	defrouter not specified
+dataset:
+	name: fast/zone/media
+	alias: media
+capped-memory:
+	physical: 2G
+	[swap: 4G]
+capped-cpu:
+	[ncpus: 1.50]
+dedicated-cpu:
+	ncpus: 1-2
+	importance: 1
+rctl:
+	name: zone.cpu-shares
+	value: (priv=privileged,limit=20,action=none)
+attr:
+	name: owner
+	type: string
+	value: media-team`
+
 var zoneadmOutput = `0:global:running:/::ipkg:shared:0
 42:cube-media:running:/zones/cube-media:c624d04f-d0d9-e1e6-822e-acebc78ec9ff:lipkg:excl:128
 44:cube-ws:installed:/zones/cube-ws:0f9c56f4-9810-6d45-f801-d34bf27cc13f:pkgsrc:excl:179`
@@ -0,0 +1,27 @@
+package helpers
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MatchesAny says whether the string matches any of the given glob patterns. '*' matches any
+// string, and '?' any single character. As with svcs(1), and unlike path.Match, '*' matches '/'
+// too. Every plugin which takes globs uses this, so they all behave the same way.
+func MatchesAny(str string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if globToRegexp(pattern).MatchString(str) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func globToRegexp(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+
+	return regexp.MustCompile("^" + pattern + "$")
+}
@@ -0,0 +1,19 @@
+package helpers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMatchesAny(t *testing.T) {
+	assert.True(t, MatchesAny("svc:/network/http:apache24", []string{"svc:/network/http:*"}))
+	assert.True(t, MatchesAny("svc:/site/app:default", []string{"svc:/x", "svc:/site/*"}))
+	assert.True(t, MatchesAny("svc:/system/cron:default", []string{"svc:/system/cro?:default"}))
+	assert.True(t, MatchesAny("cube-media", []string{"cube-*"}))
+	assert.True(t, MatchesAny("cube-ws", []string{"*-ws", "*-test"}))
+	assert.True(t, MatchesAny("a.b+c", []string{"a.b+c"}))
+	assert.False(t, MatchesAny("axb+c", []string{"a.b+c"}))
+	assert.False(t, MatchesAny("svc:/network/http:apache24", []string{"svc:/network/http"}))
+	assert.False(t, MatchesAny("svc:/system/cron:default", []string{}))
+	assert.False(t, MatchesAny("cube-media", []string{"media"}))
+}
@@ -0,0 +1,38 @@
+// Package helpers holds code shared by more than one of the plugins in this repository.
+package helpers
+
+import (
+	"github.com/siebenmann/go-kstat"
+	sth "github.com/snltd/solaris-telegraf-helpers"
+)
+
+// ZoneBootTimes gets the time at which each running zone booted, from the zone_misc kstats. If
+// the kstats cannot be read, the map is empty.
+func ZoneBootTimes() map[string]float64 {
+	ret := make(map[string]float64)
+	token, err := kstat.Open()
+
+	if err != nil {
+		return ret
+	}
+
+	defer token.Close()
+
+	for _, ks := range sth.KstatClass(token, "zone_misc") {
+		zonename, err := ks.GetNamed("zonename")
+
+		if err != nil {
+			continue
+		}
+
+		bootTime, err := ks.GetNamed("boot_time")
+
+		if err != nil {
+			continue
+		}
+
+		ret[zonename.StringVal] = float64(bootTime.UintVal)
+	}
+
+	return ret
+}